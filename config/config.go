@@ -14,10 +14,16 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -43,10 +49,15 @@ var (
 
 	// DefaultModule set default configuration for the Module
 	DefaultModule = Module{
-		HTTP: DefaultHTTPProbe,
-		TCP:  DefaultTCPProbe,
-		ICMP: DefaultICMPProbe,
-		DNS:  DefaultDNSProbe,
+		HTTP:       DefaultHTTPProbe,
+		TCP:        DefaultTCPProbe,
+		ICMP:       DefaultICMPProbe,
+		DNS:        DefaultDNSProbe,
+		Traceroute: DefaultTracerouteProbe,
+		UDP:        DefaultUDPProbe,
+		HTTPProxy:  DefaultHTTPProxyProbe,
+		GRPC:       DefaultGRPCProbe,
+		WebSocket:  DefaultWebSocketProbe,
 	}
 
 	// DefaultHTTPProbe set default value for HTTPProbe
@@ -64,6 +75,31 @@ var (
 		IPProtocolFallback: true,
 	}
 
+	// DefaultHTTPProxyProbe set default value for HTTPProxyProbe
+	DefaultHTTPProxyProbe = HTTPProxyProbe{
+		IPProtocolFallback: true,
+	}
+
+	// DefaultGRPCProbe set default value for GRPCProbe
+	DefaultGRPCProbe = GRPCProbe{
+		IPProtocolFallback: true,
+	}
+
+	// DefaultWebSocketProbe set default value for WebSocketProbe
+	DefaultWebSocketProbe = WebSocketProbe{
+		IPProtocolFallback: true,
+	}
+
+	// DefaultUDPProbe set default value for UDPProbe
+	DefaultUDPProbe = UDPProbe{
+		IPProtocolFallback: true,
+	}
+
+	// DefaultTracerouteProbe set default value for TracerouteProbe
+	DefaultTracerouteProbe = TracerouteProbe{
+		IPProtocolFallback: true,
+	}
+
 	// DefaultDNSProbe set default value for DNSProbe
 	DefaultDNSProbe = DNSProbe{
 		IPProtocolFallback: true,
@@ -115,12 +151,71 @@ func (sc *SafeConfig) ReloadConfig(confFile string) (err error) {
 }
 
 type Module struct {
-	Prober  string        `yaml:"prober,omitempty"`
-	Timeout time.Duration `yaml:"timeout,omitempty"`
-	HTTP    HTTPProbe     `yaml:"http,omitempty"`
-	TCP     TCPProbe      `yaml:"tcp,omitempty"`
-	ICMP    ICMPProbe     `yaml:"icmp,omitempty"`
-	DNS     DNSProbe      `yaml:"dns,omitempty"`
+	Prober     string          `yaml:"prober,omitempty"`
+	Timeout    time.Duration   `yaml:"timeout,omitempty"`
+	HTTP       HTTPProbe       `yaml:"http,omitempty"`
+	TCP        TCPProbe        `yaml:"tcp,omitempty"`
+	ICMP       ICMPProbe       `yaml:"icmp,omitempty"`
+	DNS        DNSProbe        `yaml:"dns,omitempty"`
+	Traceroute TracerouteProbe `yaml:"traceroute,omitempty"`
+	UDP        UDPProbe        `yaml:"udp,omitempty"`
+	HTTPProxy  HTTPProxyProbe  `yaml:"http_proxy,omitempty"`
+	GRPC       GRPCProbe       `yaml:"grpc,omitempty"`
+	WebSocket  WebSocketProbe  `yaml:"websocket,omitempty"`
+	// PROXY protocol header sent on TCP and HTTP connections.
+	ProxyProtocol ProxyProtocol `yaml:"proxy_protocol,omitempty"`
+	// SOCKS5 or HTTP CONNECT proxy used to reach TCP, HTTP, gRPC and DNS targets.
+	ProxyDialer ProxyDialer `yaml:"proxy_dialer,omitempty"`
+	// Resolution of the names of targets.
+	Resolver Resolver `yaml:"resolver,omitempty"`
+	// Succeed only if the probe fails, with one of the classes if set.
+	ExpectFailure          bool     `yaml:"expect_failure,omitempty"`
+	ExpectedFailureClasses []string `yaml:"expected_failure_classes,omitempty"`
+	// Probe every address of the target concurrently, of the preferred IP
+	// family or of both.
+	ProbeAllAddresses  bool `yaml:"probe_all_addresses,omitempty"`
+	AllAddressFamilies bool `yaml:"all_address_families,omitempty"`
+	// Probe over both IPv4 and IPv6 concurrently.
+	DualStack bool `yaml:"dual_stack,omitempty"`
+	// How the results of several probes make up probe_success: all, any
+	// or quorum. Defaults to all.
+	SuccessPolicy string `yaml:"success_policy,omitempty"`
+}
+
+type ProxyProtocol struct {
+	// 1 or 2, no header is sent if unset.
+	Version int `yaml:"version,omitempty"`
+	// Addresses as ip:port, default to those of the connection.
+	SourceAddress      string             `yaml:"source_address,omitempty"`
+	DestinationAddress string             `yaml:"destination_address,omitempty"`
+	TLVs               []ProxyProtocolTLV `yaml:"tlvs,omitempty"`
+}
+
+// Resolver configures how the names of targets are resolved.
+type Resolver struct {
+	// Static addresses by host name, used instead of DNS.
+	Overrides map[string][]string `yaml:"overrides,omitempty"`
+	// host:port of the DNS server to use instead of the system resolver.
+	Server     string           `yaml:"server,omitempty"`
+	DNSOverTLS bool             `yaml:"dns_over_tls,omitempty"`
+	TLSConfig  config.TLSConfig `yaml:"tls_config,omitempty"`
+}
+
+type ProxyDialer struct {
+	// socks5://host:port or http://host:port.
+	URL      config.URL    `yaml:"url,omitempty"`
+	Username string        `yaml:"username,omitempty"`
+	Password config.Secret `yaml:"password,omitempty"`
+	// Headers sent with HTTP CONNECT requests.
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+type ProxyProtocolTLV struct {
+	Type       int    `yaml:"type"`
+	Value      string `yaml:"value,omitempty"`
+	ValueBytes string `yaml:"value_bytes,omitempty"`
+	// Encoding of ValueBytes, hex or base64. Defaults to hex.
+	BytesEncoding string `yaml:"bytes_encoding,omitempty"`
 }
 
 type HTTPProbe struct {
@@ -129,6 +224,10 @@ type HTTPProbe struct {
 	ValidHTTPVersions            []string                `yaml:"valid_http_versions,omitempty"`
 	IPProtocol                   string                  `yaml:"preferred_ip_protocol,omitempty"`
 	IPProtocolFallback           bool                    `yaml:"ip_protocol_fallback,omitempty"`
+	SourceIPAddress              string                  `yaml:"source_ip_address,omitempty"`
+	SourceInterface              string                  `yaml:"source_interface,omitempty"`
+	HappyEyeballs                bool                    `yaml:"happy_eyeballs,omitempty"`
+	HappyEyeballsAttemptDelay    time.Duration           `yaml:"happy_eyeballs_attempt_delay,omitempty"`
 	NoFollowRedirects            bool                    `yaml:"no_follow_redirects,omitempty"`
 	FailIfSSL                    bool                    `yaml:"fail_if_ssl,omitempty"`
 	FailIfNotSSL                 bool                    `yaml:"fail_if_not_ssl,omitempty"`
@@ -139,36 +238,194 @@ type HTTPProbe struct {
 	FailIfHeaderMatchesRegexp    []HeaderMatch           `yaml:"fail_if_header_matches,omitempty"`
 	FailIfHeaderNotMatchesRegexp []HeaderMatch           `yaml:"fail_if_header_not_matches,omitempty"`
 	Body                         string                  `yaml:"body,omitempty"`
+	Metrics                      []MetricExtraction      `yaml:"metrics,omitempty"`
+	EventStream                  HTTPEventStream         `yaml:"event_stream,omitempty"`
+	HTTP2Mode                    string                  `yaml:"http2_mode,omitempty"`
 	HTTPClientConfig             config.HTTPClientConfig `yaml:"http_client_config,inline"`
 }
 
+// HTTPEventStream reads the response as a text/event-stream. It is enabled by
+// setting Events or Expect.
+type HTTPEventStream struct {
+	// Number of events to wait for, defaults to one.
+	Events int `yaml:"events,omitempty"`
+	// Regexp the data of one of the events must match.
+	Expect string `yaml:"expect,omitempty"`
+	// Only count events of this type.
+	Event string `yaml:"event,omitempty"`
+}
+
 type HeaderMatch struct {
 	Header       string `yaml:"header,omitempty"`
 	Regexp       string `yaml:"regexp,omitempty"`
 	AllowMissing bool   `yaml:"allow_missing,omitempty"`
 }
 
+// MetricExtraction turns the named groups of regexp matches in a response
+// into a gauge.
+type MetricExtraction struct {
+	// Name of the gauge, may reference named groups like ${name}.
+	Name string `yaml:"name,omitempty"`
+	Help string `yaml:"help,omitempty"`
+	// Applied to the whole response. For query_response steps, it defaults
+	// to matching expect, and is applied to every line read otherwise.
+	Regexp string `yaml:"regexp,omitempty"`
+	// Named group holding the value, defaults to "value".
+	ValueGroup string `yaml:"value_group,omitempty"`
+	// Label values may reference named groups like the name.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
 type QueryResponse struct {
-	Expect   string `yaml:"expect,omitempty"`
-	Send     string `yaml:"send,omitempty"`
-	StartTLS bool   `yaml:"starttls,omitempty"`
+	Expect      string `yaml:"expect,omitempty"`
+	ExpectBytes string `yaml:"expect_bytes,omitempty"`
+	Send        string `yaml:"send,omitempty"`
+	SendBytes   string `yaml:"send_bytes,omitempty"`
+	// Encoding of SendBytes and ExpectBytes, hex or base64. Defaults to hex.
+	BytesEncoding string `yaml:"bytes_encoding,omitempty"`
+	// Do not append a newline to Send.
+	NoTrailingNewline bool `yaml:"no_trailing_newline,omitempty"`
+	// Responses are read up to Delimiter, a newline by default, or in
+	// chunks of ReadBytes bytes.
+	Delimiter string `yaml:"delimiter,omitempty"`
+	ReadBytes int    `yaml:"read_bytes,omitempty"`
+	StartTLS  bool   `yaml:"starttls,omitempty"`
+	// How long the step may take, defaults to the rest of the probe timeout.
+	Timeout time.Duration      `yaml:"timeout,omitempty"`
+	Metrics []MetricExtraction `yaml:"metrics,omitempty"`
 }
 
 type TCPProbe struct {
 	IPProtocol         string           `yaml:"preferred_ip_protocol,omitempty"`
 	IPProtocolFallback bool             `yaml:"ip_protocol_fallback,omitempty"`
 	SourceIPAddress    string           `yaml:"source_ip_address,omitempty"`
+	SourceInterface    string           `yaml:"source_interface,omitempty"`
 	QueryResponse      []QueryResponse  `yaml:"query_response,omitempty"`
 	TLS                bool             `yaml:"tls,omitempty"`
 	TLSConfig          config.TLSConfig `yaml:"tls_config,omitempty"`
+	// Race connections to the addresses of both IP families as per RFC 8305
+	// instead of choosing one with preferred_ip_protocol. The attempt delay
+	// defaults to 250ms.
+	HappyEyeballs             bool          `yaml:"happy_eyeballs,omitempty"`
+	HappyEyeballsAttemptDelay time.Duration `yaml:"happy_eyeballs_attempt_delay,omitempty"`
+	// Application protocol used to negotiate TLS right after connecting.
+	StartTLSProtocol string `yaml:"starttls_protocol,omitempty"`
+}
+
+type HTTPProxyProbe struct {
+	IPProtocol         string `yaml:"preferred_ip_protocol,omitempty"`
+	IPProtocolFallback bool   `yaml:"ip_protocol_fallback,omitempty"`
+	// URL fetched through the proxy.
+	URL string `yaml:"url,omitempty"`
+	// connect or plain. Defaults to connect for https URLs, plain otherwise.
+	Mode    string            `yaml:"mode,omitempty"`
+	Method  string            `yaml:"method,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Defaults to 2xx.
+	ValidStatusCodes []int             `yaml:"valid_status_codes,omitempty"`
+	ProxyUsername    string            `yaml:"proxy_username,omitempty"`
+	ProxyPassword    config.Secret     `yaml:"proxy_password,omitempty"`
+	ProxyHeaders     map[string]string `yaml:"proxy_headers,omitempty"`
+	TLSConfig        config.TLSConfig  `yaml:"tls_config,omitempty"`
+}
+
+type GRPCProbe struct {
+	IPProtocol         string `yaml:"preferred_ip_protocol,omitempty"`
+	IPProtocolFallback bool   `yaml:"ip_protocol_fallback,omitempty"`
+	// Service checked, the server as a whole if empty.
+	Service string `yaml:"service,omitempty"`
+	// Use TLS, plaintext HTTP/2 (h2c) otherwise.
+	TLS       bool             `yaml:"tls,omitempty"`
+	TLSConfig config.TLSConfig `yaml:"tls_config,omitempty"`
+	// Metadata sent as request headers.
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+}
+
+type WebSocketProbe struct {
+	IPProtocol         string                   `yaml:"preferred_ip_protocol,omitempty"`
+	IPProtocolFallback bool                     `yaml:"ip_protocol_fallback,omitempty"`
+	Headers            map[string]string        `yaml:"headers,omitempty"`
+	Subprotocols       []string                 `yaml:"subprotocols,omitempty"`
+	HTTPClientConfig   config.HTTPClientConfig  `yaml:"http_client_config,inline"`
+	QueryResponse      []WebSocketQueryResponse `yaml:"query_response,omitempty"`
+}
+
+type WebSocketQueryResponse struct {
+	Expect      string `yaml:"expect,omitempty"`
+	ExpectBytes string `yaml:"expect_bytes,omitempty"`
+	// Send is sent as a text message, SendBytes as a binary one.
+	Send      string `yaml:"send,omitempty"`
+	SendBytes string `yaml:"send_bytes,omitempty"`
+	// Encoding of SendBytes and ExpectBytes, hex or base64. Defaults to hex.
+	BytesEncoding string `yaml:"bytes_encoding,omitempty"`
+	// Send a ping and wait for the pong.
+	Ping    bool          `yaml:"ping,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+type UDPQueryResponse struct {
+	Expect      string `yaml:"expect,omitempty"`
+	ExpectBytes string `yaml:"expect_bytes,omitempty"`
+	Send        string `yaml:"send,omitempty"`
+	SendBytes   string `yaml:"send_bytes,omitempty"`
+	// Encoding of SendBytes and ExpectBytes, hex or base64. Defaults to hex.
+	BytesEncoding string `yaml:"bytes_encoding,omitempty"`
+}
+
+type UDPProbe struct {
+	IPProtocol         string             `yaml:"preferred_ip_protocol,omitempty"`
+	IPProtocolFallback bool               `yaml:"ip_protocol_fallback,omitempty"`
+	SourceIPAddress    string             `yaml:"source_ip_address,omitempty"`
+	SourceInterface    string             `yaml:"source_interface,omitempty"`
+	QueryResponse      []UDPQueryResponse `yaml:"query_response,omitempty"`
+	// How long to wait for an expected datagram, defaults to the probe timeout.
+	ReadTimeout time.Duration `yaml:"read_timeout,omitempty"`
 }
 
 type ICMPProbe struct {
 	IPProtocol         string `yaml:"preferred_ip_protocol,omitempty"` // Defaults to "ip6".
 	IPProtocolFallback bool   `yaml:"ip_protocol_fallback,omitempty"`
 	SourceIPAddress    string `yaml:"source_ip_address,omitempty"`
+	SourceInterface    string `yaml:"source_interface,omitempty"`
 	PayloadSize        int    `yaml:"payload_size,omitempty"`
 	DontFragment       bool   `yaml:"dont_fragment,omitempty"`
+	// Number of echo requests to send, defaults to 1.
+	PacketCount int `yaml:"packet_count,omitempty"`
+	// Delay between echo requests, defaults to 1s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// How long to wait for replies after the last echo request, defaults to 1s.
+	ReplyTimeout time.Duration `yaml:"reply_timeout,omitempty"`
+	// Highest ratio of lost packets that still makes the probe succeed.
+	MaxPacketLossRatio float64 `yaml:"max_packet_loss_ratio,omitempty"`
+	// TTL (hop limit for ip6) of the echo requests, defaults to the system default.
+	TTL  int `yaml:"ttl,omitempty"`
+	DSCP int `yaml:"dscp,omitempty"`
+	// One of text, random, incrementing or hex. Defaults to text.
+	PayloadPattern string `yaml:"payload_pattern,omitempty"`
+	PayloadHex     string `yaml:"payload_hex,omitempty"`
+	// Search the largest packet that reaches the target unfragmented.
+	PathMTUDiscovery bool `yaml:"path_mtu_discovery,omitempty"`
+	// Upper bound of the path MTU search, defaults to 1500.
+	MaxMTU int `yaml:"max_mtu,omitempty"`
+}
+
+type TracerouteProbe struct {
+	IPProtocol         string `yaml:"preferred_ip_protocol,omitempty"` // Defaults to "ip6".
+	IPProtocolFallback bool   `yaml:"ip_protocol_fallback,omitempty"`
+	SourceIPAddress    string `yaml:"source_ip_address,omitempty"`
+	SourceInterface    string `yaml:"source_interface,omitempty"`
+	// One of icmp, udp or tcp. Defaults to icmp.
+	Protocol string `yaml:"protocol,omitempty"`
+	// Destination port of udp and tcp probes, defaults to 33434 and 80.
+	Port int `yaml:"port,omitempty"`
+	// TTL of the first probes, defaults to 1.
+	FirstHop int `yaml:"first_hop,omitempty"`
+	// Highest TTL to probe with, defaults to 30.
+	MaxHops int `yaml:"max_hops,omitempty"`
+	// Number of probes sent per hop, defaults to 3.
+	PacketsPerHop int `yaml:"packets_per_hop,omitempty"`
+	// How long to wait for the responses of a hop, defaults to 1s.
+	HopTimeout time.Duration `yaml:"hop_timeout,omitempty"`
 }
 
 type DNSProbe struct {
@@ -177,14 +434,20 @@ type DNSProbe struct {
 	DNSOverTLS         bool             `yaml:"dns_over_tls,omitempty"`
 	TLSConfig          config.TLSConfig `yaml:"tls_config,omitempty"`
 	SourceIPAddress    string           `yaml:"source_ip_address,omitempty"`
+	SourceInterface    string           `yaml:"source_interface,omitempty"`
 	TransportProtocol  string           `yaml:"transport_protocol,omitempty"`
 	QueryClass         string           `yaml:"query_class,omitempty"` // Defaults to IN.
 	QueryName          string           `yaml:"query_name,omitempty"`
-	QueryType          string           `yaml:"query_type,omitempty"`   // Defaults to ANY.
-	ValidRcodes        []string         `yaml:"valid_rcodes,omitempty"` // Defaults to NOERROR.
+	QueryType          string           `yaml:"query_type,omitempty"`        // Defaults to ANY.
+	Recursion          *bool            `yaml:"recursion_desired,omitempty"` // Defaults to true.
+	ValidRcodes        []string         `yaml:"valid_rcodes,omitempty"`      // Defaults to NOERROR.
 	ValidateAnswer     DNSRRValidator   `yaml:"validate_answer_rrs,omitempty"`
 	ValidateAuthority  DNSRRValidator   `yaml:"validate_authority_rrs,omitempty"`
 	ValidateAdditional DNSRRValidator   `yaml:"validate_additional_rrs,omitempty"`
+
+	FailIfNotAuthoritative     bool `yaml:"fail_if_not_authoritative,omitempty"`
+	FailIfRecursionUnavailable bool `yaml:"fail_if_recursion_unavailable,omitempty"`
+	FailIfTruncated            bool `yaml:"fail_if_truncated,omitempty"`
 }
 
 type DNSRRValidator struct {
@@ -210,6 +473,51 @@ func (s *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
+	for _, class := range s.ExpectedFailureClasses {
+		switch class {
+		case "refused", "timeout", "tls_handshake", "status":
+		default:
+			return fmt.Errorf("failure class '%s' is not valid", class)
+		}
+	}
+	if len(s.ExpectedFailureClasses) > 0 && !s.ExpectFailure {
+		return errors.New("\"expected_failure_classes\" requires \"expect_failure\"")
+	}
+	switch s.SuccessPolicy {
+	case "", "all", "any", "quorum":
+	default:
+		return fmt.Errorf("success policy '%s' is not valid", s.SuccessPolicy)
+	}
+	if s.SuccessPolicy != "" && !s.ProbeAllAddresses && !s.DualStack {
+		return errors.New("\"success_policy\" requires \"probe_all_addresses\" or \"dual_stack\"")
+	}
+	if s.DualStack && s.ProbeAllAddresses {
+		return errors.New("dual_stack cannot be combined with probe_all_addresses, use all_address_families instead")
+	}
+	// The proxy connects to an address of its own choosing, and the failure
+	// class of a single address does not tell the class of the combined
+	// result.
+	if s.ProbeAllAddresses && s.ProxyDialer.URL.URL != nil {
+		return errors.New("probe_all_addresses cannot be combined with proxy_dialer")
+	}
+	if s.ProbeAllAddresses && s.ExpectFailure {
+		return errors.New("probe_all_addresses cannot be combined with expect_failure")
+	}
+	if s.DualStack && s.ProxyDialer.URL.URL != nil {
+		return errors.New("dual_stack cannot be combined with proxy_dialer")
+	}
+	if s.DualStack && s.ExpectFailure {
+		return errors.New("dual_stack cannot be combined with expect_failure")
+	}
+	if s.DualStack && (s.HTTP.HappyEyeballs || s.TCP.HappyEyeballs) {
+		return errors.New("dual_stack cannot be combined with happy_eyeballs")
+	}
+	if s.AllAddressFamilies && !s.ProbeAllAddresses {
+		return errors.New("\"all_address_families\" requires \"probe_all_addresses\"")
+	}
+	if s.ProxyProtocol.Version != 0 && s.ProxyDialer.URL.URL != nil && (s.ProxyProtocol.SourceAddress == "" || s.ProxyProtocol.DestinationAddress == "") {
+		return errors.New("proxy_protocol with proxy_dialer requires \"source_address\" and \"destination_address\"")
+	}
 	return nil
 }
 
@@ -223,6 +531,41 @@ func (s *HTTPProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := s.HTTPClientConfig.Validate(); err != nil {
 		return err
 	}
+	for _, m := range s.Metrics {
+		if m.Regexp == "" {
+			return errors.New("regexp must be set for HTTP metrics")
+		}
+	}
+	switch s.HTTP2Mode {
+	case "", "tls", "prior_knowledge", "upgrade":
+	default:
+		return fmt.Errorf("http2 mode '%s' is not valid", s.HTTP2Mode)
+	}
+	if s.HTTP2Mode != "" && s.HTTPClientConfig.ProxyURL.URL != nil {
+		return errors.New("http2_mode cannot be combined with proxy_url")
+	}
+	if s.HTTP2Mode == "upgrade" && (s.EventStream.Events > 0 || s.EventStream.Expect != "") {
+		return errors.New("http2_mode upgrade cannot be combined with event_stream")
+	}
+	if s.EventStream.Events < 0 {
+		return errors.New("\"events\" must not be negative")
+	}
+	if (s.EventStream.Events > 0 || s.EventStream.Expect != "") &&
+		(len(s.FailIfBodyMatchesRegexp) > 0 || len(s.FailIfBodyNotMatchesRegexp) > 0 || len(s.Metrics) > 0) {
+		return errors.New("event_stream cannot be combined with body regexps or metrics")
+	}
+	return validateHappyEyeballs(s.HappyEyeballs, s.HappyEyeballsAttemptDelay)
+}
+
+// validateHappyEyeballs checks the Happy Eyeballs settings of a prober.
+func validateHappyEyeballs(enabled bool, attemptDelay time.Duration) error {
+	if attemptDelay != 0 && !enabled {
+		return errors.New("\"happy_eyeballs_attempt_delay\" requires \"happy_eyeballs\"")
+	}
+	// RFC 8305 section 5 sets a lower bound of 10ms.
+	if attemptDelay != 0 && attemptDelay < 10*time.Millisecond {
+		return errors.New("\"happy_eyeballs_attempt_delay\" must be at least 10ms")
+	}
 	return nil
 }
 
@@ -257,7 +600,15 @@ func (s *TCPProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
-	return nil
+	switch s.StartTLSProtocol {
+	case "", "smtp", "imap", "pop3", "ftp", "xmpp", "ldap", "postgres", "mysql":
+	default:
+		return fmt.Errorf("starttls protocol '%s' is not valid", s.StartTLSProtocol)
+	}
+	if s.StartTLSProtocol != "" && s.TLS {
+		return errors.New("at most one of tls & starttls_protocol must be configured")
+	}
+	return validateHappyEyeballs(s.HappyEyeballs, s.HappyEyeballsAttemptDelay)
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -280,6 +631,79 @@ func (s *ICMPProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if runtime.GOOS == "windows" && s.DontFragment {
 		return errors.New("\"dont_fragment\" is not supported on windows platforms")
 	}
+	if s.PacketCount < 0 {
+		return errors.New("\"packet_count\" must not be negative")
+	}
+	if s.Interval < 0 {
+		return errors.New("\"interval\" must not be negative")
+	}
+	if s.ReplyTimeout < 0 {
+		return errors.New("\"reply_timeout\" must not be negative")
+	}
+	if s.MaxPacketLossRatio < 0 || s.MaxPacketLossRatio > 1 {
+		return errors.New("\"max_packet_loss_ratio\" must be between 0 and 1")
+	}
+	if s.TTL < 0 || s.TTL > 255 {
+		return errors.New("\"ttl\" must be between 0 and 255")
+	}
+	if s.DSCP < 0 || s.DSCP > 63 {
+		return errors.New("\"dscp\" must be between 0 and 63")
+	}
+	if runtime.GOOS == "windows" && s.PathMTUDiscovery {
+		return errors.New("\"path_mtu_discovery\" is not supported on windows platforms")
+	}
+	if s.MaxMTU != 0 && (s.MaxMTU < 68 || s.MaxMTU > 65535) {
+		return errors.New("\"max_mtu\" must be between 68 and 65535")
+	}
+	if runtime.GOOS == "windows" && (s.TTL != 0 || s.DSCP != 0) {
+		return errors.New("\"ttl\" and \"dscp\" are not supported on windows platforms")
+	}
+	switch s.PayloadPattern {
+	case "", "text", "random", "incrementing":
+		if s.PayloadHex != "" {
+			return errors.New("\"payload_hex\" requires \"payload_pattern\" to be hex")
+		}
+	case "hex":
+		if b, err := hex.DecodeString(s.PayloadHex); err != nil || len(b) == 0 {
+			return fmt.Errorf("\"payload_hex\" must be a non-empty hex string: %q", s.PayloadHex)
+		}
+	default:
+		return fmt.Errorf("payload pattern '%s' is not valid", s.PayloadPattern)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *TracerouteProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = DefaultTracerouteProbe
+	type plain TracerouteProbe
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		return errors.New("traceroute is not supported on windows platforms")
+	}
+	switch s.Protocol {
+	case "", "icmp", "udp", "tcp":
+	default:
+		return fmt.Errorf("traceroute protocol '%s' is not valid", s.Protocol)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return errors.New("\"port\" must be between 0 and 65535")
+	}
+	if s.FirstHop < 0 || s.FirstHop > 255 || s.MaxHops < 0 || s.MaxHops > 255 {
+		return errors.New("\"first_hop\" and \"max_hops\" must be between 0 and 255")
+	}
+	if s.MaxHops != 0 && s.FirstHop > s.MaxHops {
+		return errors.New("\"first_hop\" must not be greater than \"max_hops\"")
+	}
+	if s.PacketsPerHop < 0 {
+		return errors.New("\"packets_per_hop\" must not be negative")
+	}
+	if s.HopTimeout < 0 {
+		return errors.New("\"hop_timeout\" must not be negative")
+	}
 	return nil
 }
 
@@ -289,6 +713,271 @@ func (s *QueryResponse) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
+	if s.Send != "" && s.SendBytes != "" {
+		return errors.New("at most one of send & send_bytes must be configured")
+	}
+	for _, b := range []string{s.SendBytes, s.ExpectBytes} {
+		if err := validateBytes(b, s.BytesEncoding); err != nil {
+			return err
+		}
+	}
+	if s.ReadBytes < 0 {
+		return errors.New("\"read_bytes\" must not be negative")
+	}
+	if s.ReadBytes > 0 && s.Delimiter != "" {
+		return errors.New("at most one of delimiter & read_bytes must be configured")
+	}
+	if s.Timeout < 0 {
+		return errors.New("\"timeout\" must not be negative")
+	}
+	for _, m := range s.Metrics {
+		if m.Regexp == "" && s.Expect == "" {
+			return errors.New("regexp must be set for metrics of steps without expect")
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *UDPProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = DefaultUDPProbe
+	type plain UDPProbe
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.ReadTimeout < 0 {
+		return errors.New("\"read_timeout\" must not be negative")
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *HTTPProxyProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = DefaultHTTPProxyProbe
+	type plain HTTPProxyProbe
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.URL == "" {
+		return errors.New("url must be set for http_proxy module")
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("http proxy url '%s' is not valid", s.URL)
+	}
+	switch s.Mode {
+	case "", "connect":
+	case "plain":
+		if u.Scheme != "http" {
+			return errors.New("plain mode requires an http url")
+		}
+	default:
+		return fmt.Errorf("http proxy mode '%s' is not valid", s.Mode)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *GRPCProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = DefaultGRPCProbe
+	type plain GRPCProbe
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	for key := range s.Metadata {
+		if !validGRPCMetadataKey(key) {
+			return fmt.Errorf("metadata key '%s' is not valid", key)
+		}
+	}
+	return nil
+}
+
+// validGRPCMetadataKey checks that key is a lower case header name, not
+// reserved by gRPC.
+func validGRPCMetadataKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "grpc-") {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *WebSocketProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = DefaultWebSocketProbe
+	type plain WebSocketProbe
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	return s.HTTPClientConfig.Validate()
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *WebSocketQueryResponse) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain WebSocketQueryResponse
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.Send != "" && s.SendBytes != "" {
+		return errors.New("at most one of send & send_bytes must be configured")
+	}
+	if s.Ping && (s.Send != "" || s.SendBytes != "") {
+		return errors.New("ping cannot be combined with send or send_bytes")
+	}
+	if s.Timeout < 0 {
+		return errors.New("\"timeout\" must not be negative")
+	}
+	for _, b := range []string{s.SendBytes, s.ExpectBytes} {
+		if err := validateBytes(b, s.BytesEncoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *UDPQueryResponse) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain UDPQueryResponse
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.Send != "" && s.SendBytes != "" {
+		return errors.New("at most one of send & send_bytes must be configured")
+	}
+	for _, b := range []string{s.SendBytes, s.ExpectBytes} {
+		if err := validateBytes(b, s.BytesEncoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ProxyProtocol) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ProxyProtocol
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.Version != 1 && s.Version != 2 {
+		return fmt.Errorf("proxy protocol version '%d' is not valid", s.Version)
+	}
+	if err := validateIPPort("source_address", s.SourceAddress); err != nil {
+		return err
+	}
+	if err := validateIPPort("destination_address", s.DestinationAddress); err != nil {
+		return err
+	}
+	if len(s.TLVs) > 0 && s.Version != 2 {
+		return errors.New("\"tlvs\" require proxy protocol version 2")
+	}
+	for _, tlv := range s.TLVs {
+		if tlv.Type < 0 || tlv.Type > 255 {
+			return fmt.Errorf("TLV type '%d' is not valid", tlv.Type)
+		}
+		if tlv.Value != "" && tlv.ValueBytes != "" {
+			return errors.New("at most one of value & value_bytes must be configured")
+		}
+		if err := validateBytes(tlv.ValueBytes, tlv.BytesEncoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ProxyDialer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ProxyDialer
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.URL.URL == nil || s.URL.Host == "" {
+		return errors.New("\"url\" must be set for proxy_dialer")
+	}
+	switch s.URL.Scheme {
+	case "socks5":
+		if len(s.Headers) > 0 {
+			return errors.New("\"headers\" are only supported for http proxies")
+		}
+	case "http":
+	default:
+		return fmt.Errorf("proxy dialer scheme '%s' is not valid", s.URL.Scheme)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Resolver) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Resolver
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	for host, addrs := range s.Overrides {
+		if len(addrs) == 0 {
+			return fmt.Errorf("no addresses for resolver override '%s'", host)
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				return fmt.Errorf("resolver override address '%s' is not valid", addr)
+			}
+		}
+	}
+	if s.DNSOverTLS && s.Server == "" {
+		return errors.New("\"dns_over_tls\" requires \"server\" for resolver")
+	}
+	return nil
+}
+
+// validateIPPort checks that addr is empty or an IP address and port.
+func validateIPPort(name, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("%q must be an IP address and port: %q", name, addr)
+	}
+	return nil
+}
+
+// validateBytes checks that b is valid in the given bytes encoding.
+func validateBytes(b, encoding string) error {
+	if encoding == "" {
+		encoding = "hex"
+	}
+	var err error
+	switch encoding {
+	case "hex":
+		_, err = hex.DecodeString(b)
+	case "base64":
+		_, err = base64.StdEncoding.DecodeString(b)
+	default:
+		return fmt.Errorf("bytes encoding '%s' is not valid", encoding)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s bytes %q: %s", encoding, b, err)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *MetricExtraction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MetricExtraction
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if s.Name == "" {
+		return errors.New("name must be set for extracted metrics")
+	}
 	return nil
 }
 
@@ -63,6 +63,98 @@ func TestLoadBadConfigs(t *testing.T) {
 			ConfigFile:    "testdata/invalid-http-header-match.yml",
 			ExpectedError: "error parsing config file: regexp must be set for HTTP header matchers",
 		},
+		{
+			ConfigFile:    "testdata/invalid-icmp-payload-pattern.yml",
+			ExpectedError: "error parsing config file: payload pattern 'zeros' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-traceroute-protocol.yml",
+			ExpectedError: "error parsing config file: traceroute protocol 'sctp' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-tcp-starttls-protocol.yml",
+			ExpectedError: "error parsing config file: starttls protocol 'telnet' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-proxy-protocol-version.yml",
+			ExpectedError: "error parsing config file: proxy protocol version '3' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-proxy-protocol-proxy-dialer.yml",
+			ExpectedError: "error parsing config file: proxy_protocol with proxy_dialer requires \"source_address\" and \"destination_address\"",
+		},
+		{
+			ConfigFile:    "testdata/invalid-expected-failure-class.yml",
+			ExpectedError: "error parsing config file: failure class 'closed' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-proxy-dialer-scheme.yml",
+			ExpectedError: "error parsing config file: proxy dialer scheme 'socks4' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-http-proxy-mode.yml",
+			ExpectedError: "error parsing config file: plain mode requires an http url",
+		},
+		{
+			ConfigFile:    "testdata/invalid-grpc-metadata.yml",
+			ExpectedError: "error parsing config file: metadata key 'grpc-timeout' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-websocket-ping-send.yml",
+			ExpectedError: "error parsing config file: ping cannot be combined with send or send_bytes",
+		},
+		{
+			ConfigFile:    "testdata/invalid-udp-bytes-encoding.yml",
+			ExpectedError: "error parsing config file: bytes encoding 'base32' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-tcp-query-response-send.yml",
+			ExpectedError: "error parsing config file: at most one of send & send_bytes must be configured",
+		},
+		{
+			ConfigFile:    "testdata/invalid-http-metrics.yml",
+			ExpectedError: "error parsing config file: regexp must be set for HTTP metrics",
+		},
+		{
+			ConfigFile:    "testdata/invalid-http-event-stream.yml",
+			ExpectedError: "error parsing config file: event_stream cannot be combined with body regexps or metrics",
+		},
+		{
+			ConfigFile:    "testdata/invalid-http-http2-mode.yml",
+			ExpectedError: "error parsing config file: http2 mode 'h2' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-http-http2-upgrade-event-stream.yml",
+			ExpectedError: "error parsing config file: http2_mode upgrade cannot be combined with event_stream",
+		},
+		{
+			ConfigFile:    "testdata/invalid-resolver-override.yml",
+			ExpectedError: "error parsing config file: resolver override address '10.0.0.300' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-success-policy.yml",
+			ExpectedError: "error parsing config file: success policy 'majority' is not valid",
+		},
+		{
+			ConfigFile:    "testdata/invalid-dual-stack.yml",
+			ExpectedError: "error parsing config file: dual_stack cannot be combined with probe_all_addresses, use all_address_families instead",
+		},
+		{
+			ConfigFile:    "testdata/invalid-probe-all-addresses-proxy-dialer.yml",
+			ExpectedError: "error parsing config file: probe_all_addresses cannot be combined with proxy_dialer",
+		},
+		{
+			ConfigFile:    "testdata/invalid-probe-all-addresses-expect-failure.yml",
+			ExpectedError: "error parsing config file: probe_all_addresses cannot be combined with expect_failure",
+		},
+		{
+			ConfigFile:    "testdata/invalid-dual-stack-proxy-dialer.yml",
+			ExpectedError: "error parsing config file: dual_stack cannot be combined with proxy_dialer",
+		},
+		{
+			ConfigFile:    "testdata/invalid-happy-eyeballs-attempt-delay.yml",
+			ExpectedError: "error parsing config file: \"happy_eyeballs_attempt_delay\" must be at least 10ms",
+		},
 	}
 	for i, test := range tests {
 		err := sc.ReloadConfig(test.ConfigFile)
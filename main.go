@@ -60,13 +60,39 @@ var (
 	routePrefix   = kingpin.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints. Defaults to path of --web.external-url.").PlaceHolder("<path>").String()
 
 	Probers = map[string]prober.ProbeFn{
-		"http": prober.ProbeHTTP,
-		"tcp":  prober.ProbeTCP,
-		"icmp": prober.ProbeICMP,
-		"dns":  prober.ProbeDNS,
+		"http":       prober.ProbeHTTP,
+		"tcp":        prober.ProbeTCP,
+		"icmp":       prober.ProbeICMP,
+		"dns":        prober.ProbeDNS,
+		"traceroute": prober.ProbeTraceroute,
+		"udp":        prober.ProbeUDP,
+		"http_proxy": prober.ProbeHTTPProxy,
+		"grpc":       prober.ProbeGRPC,
+		"websocket":  prober.ProbeWebSocket,
 	}
 )
 
+// checkExpectedFailure inverts the result of a probe that is expected to
+// fail, as long as it failed with one of the expected classes, if any.
+func checkExpectedFailure(success bool, class string, expectedClasses []string, logger log.Logger) bool {
+	if success {
+		level.Error(logger).Log("msg", "Probe succeeded, expected a failure")
+		return false
+	}
+	if len(expectedClasses) == 0 {
+		level.Info(logger).Log("msg", "Probe failed as expected", "class", class)
+		return true
+	}
+	for _, c := range expectedClasses {
+		if c == class {
+			level.Info(logger).Log("msg", "Probe failed as expected", "class", class)
+			return true
+		}
+	}
+	level.Error(logger).Log("msg", "Probe failed with an unexpected failure class", "class", class, "expected_classes", strings.Join(expectedClasses, ","))
+	return false
+}
+
 func probeHandler(w http.ResponseWriter, r *http.Request, c *config.Config, logger log.Logger, rh *resultHistory) {
 	moduleName := r.URL.Query().Get("module")
 	if moduleName == "" {
@@ -103,6 +129,7 @@ func probeHandler(w http.ResponseWriter, r *http.Request, c *config.Config, logg
 
 	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeoutSeconds*float64(time.Second)))
 	defer cancel()
+	ctx, failureRecorder := prober.WithFailureRecorder(ctx)
 	r = r.WithContext(ctx)
 
 	probeSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
@@ -120,11 +147,17 @@ func probeHandler(w http.ResponseWriter, r *http.Request, c *config.Config, logg
 		return
 	}
 
-	prober, ok := Probers[module.Prober]
+	probeFn, ok := Probers[module.Prober]
 	if !ok {
 		http.Error(w, fmt.Sprintf("Unknown prober %q", module.Prober), http.StatusBadRequest)
 		return
 	}
+	if module.ProbeAllAddresses {
+		probeFn = prober.ProbeAllAddresses(probeFn)
+	}
+	if module.DualStack {
+		probeFn = prober.ProbeDualStack(probeFn)
+	}
 
 	sl := newScrapeLogger(logger, moduleName, target)
 	level.Info(sl).Log("msg", "Beginning probe", "probe", module.Prober, "timeout_seconds", timeoutSeconds)
@@ -133,7 +166,10 @@ func probeHandler(w http.ResponseWriter, r *http.Request, c *config.Config, logg
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(probeSuccessGauge)
 	registry.MustRegister(probeDurationGauge)
-	success := prober(ctx, target, module, registry, sl)
+	success := probeFn(ctx, target, module, registry, sl)
+	if module.ExpectFailure {
+		success = checkExpectedFailure(success, failureRecorder.Class(), module.ExpectedFailureClasses, sl)
+	}
 	duration := time.Since(start).Seconds()
 	probeDurationGauge.Set(duration)
 	if success {
@@ -190,3 +190,46 @@ func TestComputeExternalURL(t *testing.T) {
 		}
 	}
 }
+
+func TestExpectFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		classes []string
+		success bool
+	}{
+		{classes: nil, success: true},
+		{classes: []string{"status"}, success: true},
+		{classes: []string{"refused", "timeout"}, success: false},
+	}
+	for i, test := range tests {
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"http_2xx": {
+					Prober:                 "http",
+					Timeout:                5 * time.Second,
+					HTTP:                   config.HTTPProbe{IPProtocol: "ip4"},
+					ExpectFailure:          true,
+					ExpectedFailureClasses: test.classes,
+				},
+			},
+		}
+		req, err := http.NewRequest("GET", "?target="+ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, conf, log.NewNopLogger(), &resultHistory{})
+
+		want := "probe_success 0"
+		if test.success {
+			want = "probe_success 1"
+		}
+		if body := rr.Body.String(); !strings.Contains(body, want) {
+			t.Errorf("Test %d: expected %q in output: %s", i, want, body)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// targetHost returns the host name of a target, or an empty string for Unix
+// domain sockets.
+func targetHost(target string) string {
+	if strings.HasPrefix(target, "unix://") {
+		return ""
+	}
+	if net.ParseIP(target) != nil {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		if u, err = url.Parse("//" + target); err != nil {
+			return ""
+		}
+	}
+	return u.Hostname()
+}
+
+// moduleIPProtocol returns the IP protocol settings of the prober of module.
+// They are nil for probers without them.
+func moduleIPProtocol(module *config.Module) (protocol *string, fallback *bool) {
+	switch module.Prober {
+	case "http":
+		return &module.HTTP.IPProtocol, &module.HTTP.IPProtocolFallback
+	case "tcp":
+		return &module.TCP.IPProtocol, &module.TCP.IPProtocolFallback
+	case "icmp":
+		return &module.ICMP.IPProtocol, &module.ICMP.IPProtocolFallback
+	case "dns":
+		return &module.DNS.IPProtocol, &module.DNS.IPProtocolFallback
+	case "traceroute":
+		return &module.Traceroute.IPProtocol, &module.Traceroute.IPProtocolFallback
+	case "udp":
+		return &module.UDP.IPProtocol, &module.UDP.IPProtocolFallback
+	case "http_proxy":
+		return &module.HTTPProxy.IPProtocol, &module.HTTPProxy.IPProtocolFallback
+	case "grpc":
+		return &module.GRPC.IPProtocol, &module.GRPC.IPProtocolFallback
+	case "websocket":
+		return &module.WebSocket.IPProtocol, &module.WebSocket.IPProtocolFallback
+	}
+	return nil, nil
+}
+
+// pinAddress returns a copy of module resolving host to ip only.
+func pinAddress(module config.Module, host string, ip net.IP) config.Module {
+	overrides := make(map[string][]string, len(module.Resolver.Overrides)+1)
+	for k, v := range module.Resolver.Overrides {
+		overrides[k] = v
+	}
+	overrides[host] = []string{ip.String()}
+	module.Resolver.Overrides = overrides
+	if protocol, fallback := moduleIPProtocol(&module); protocol != nil {
+		*protocol = "ip6"
+		if ip.To4() != nil {
+			*protocol = "ip4"
+		}
+		*fallback = false
+	}
+	return module
+}
+
+// successByPolicy combines the results of several probes as per policy.
+func successByPolicy(policy string, results []bool) bool {
+	succeeded := 0
+	for _, success := range results {
+		if success {
+			succeeded++
+		}
+	}
+	switch policy {
+	case "any":
+		return succeeded > 0
+	case "quorum":
+		return succeeded > len(results)/2
+	default:
+		return len(results) > 0 && succeeded == len(results)
+	}
+}
+
+// labelledCollector exports the metrics of a registry with an additional
+// label.
+type labelledCollector struct {
+	gatherer prometheus.Gatherer
+	name     string
+	value    string
+}
+
+// Describe sends no descriptions, the collector is unchecked.
+func (c *labelledCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *labelledCollector) Collect(ch chan<- prometheus.Metric) {
+	mfs, err := c.gatherer.Gather()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+		return
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := []string{c.name}
+			values := []string{c.value}
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, lp.GetName())
+				values = append(values, lp.GetValue())
+			}
+			desc := prometheus.NewDesc(mf.GetName(), mf.GetHelp(), labels, nil)
+			var metric prometheus.Metric
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				metric, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), values...)
+			case dto.MetricType_GAUGE:
+				metric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), values...)
+			case dto.MetricType_UNTYPED:
+				metric, err = prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue(), values...)
+			case dto.MetricType_HISTOGRAM:
+				buckets := map[float64]uint64{}
+				for _, b := range m.GetHistogram().GetBucket() {
+					buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+				}
+				metric, err = prometheus.NewConstHistogram(desc, m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), buckets, values...)
+			case dto.MetricType_SUMMARY:
+				quantiles := map[float64]float64{}
+				for _, q := range m.GetSummary().GetQuantile() {
+					quantiles[q.GetQuantile()] = q.GetValue()
+				}
+				metric, err = prometheus.NewConstSummary(desc, m.GetSummary().GetSampleCount(), m.GetSummary().GetSampleSum(), quantiles, values...)
+			}
+			if err != nil {
+				ch <- prometheus.NewInvalidMetric(desc, err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
+
+// ProbeAllAddresses returns a ProbeFn running probe concurrently against
+// every address the target resolves to. The metrics of each probe are
+// labelled by IP, and the success of the probes is combined as per the
+// success policy of the module.
+func ProbeAllAddresses(probe ProbeFn) ProbeFn {
+	return func(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+		probeAddressesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_addresses",
+			Help: "Number of addresses of the target probed",
+		})
+		probeAddressSuccessGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_address_success",
+			Help: "Displays whether or not the probe of an address was a success",
+		}, []string{"ip"})
+
+		host := targetHost(target)
+		protocol, fallback := moduleIPProtocol(&module)
+		if host == "" || net.ParseIP(host) != nil || protocol == nil {
+			// There is nothing to choose from.
+			return probe(ctx, target, module, registry, logger)
+		}
+		registry.MustRegister(probeAddressesGauge, probeAddressSuccessGaugeVec)
+
+		level.Info(logger).Log("msg", "Resolving all target addresses")
+		addrs, err := lookupIPAddr(ctx, module.Resolver, host)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error resolving address", "err", err)
+			recordError(ctx, err)
+			return false
+		}
+		var preferred, other []net.IP
+		for _, addr := range addrs {
+			if (addr.IP.To4() == nil) == (*protocol == "ip6" || *protocol == "") {
+				preferred = append(preferred, addr.IP)
+			} else {
+				other = append(other, addr.IP)
+			}
+		}
+		ips := preferred
+		if module.AllAddressFamilies {
+			ips = append(ips, other...)
+		} else if len(ips) == 0 && *fallback {
+			ips = other
+		}
+		if len(ips) == 0 {
+			level.Error(logger).Log("msg", "No address to probe", "addresses", len(addrs))
+			return false
+		}
+		probeAddressesGauge.Set(float64(len(ips)))
+
+		results := make([]bool, len(ips))
+		var wg sync.WaitGroup
+		for i, ip := range ips {
+			ipRegistry := prometheus.NewRegistry()
+			registry.MustRegister(&labelledCollector{gatherer: ipRegistry, name: "ip", value: ip.String()})
+			wg.Add(1)
+			go func(i int, ip net.IP) {
+				defer wg.Done()
+				ipLogger := log.With(logger, "ip", ip.String())
+				results[i] = probe(ctx, target, pinAddress(module, host, ip), ipRegistry, ipLogger)
+				if results[i] {
+					level.Info(ipLogger).Log("msg", "Probe of address succeeded")
+				} else {
+					level.Error(ipLogger).Log("msg", "Probe of address failed")
+				}
+			}(i, ip)
+		}
+		wg.Wait()
+
+		for i, ip := range ips {
+			if results[i] {
+				probeAddressSuccessGaugeVec.WithLabelValues(ip.String()).Set(1)
+			} else {
+				probeAddressSuccessGaugeVec.WithLabelValues(ip.String()).Set(0)
+			}
+		}
+		return successByPolicy(module.SuccessPolicy, results)
+	}
+}
+
+// ProbeDualStack returns a ProbeFn running probe concurrently over IPv4 and
+// over IPv6. The metrics of each probe are labelled by IP family, and the
+// success of the probes is combined as per the success policy of the module.
+func ProbeDualStack(probe ProbeFn) ProbeFn {
+	return func(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+		probeIPFamilySuccessGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_ip_family_success",
+			Help: "Displays whether or not the probe over an IP family was a success",
+		}, []string{"ip_family"})
+
+		host := targetHost(target)
+		if protocol, _ := moduleIPProtocol(&module); host == "" || protocol == nil {
+			return probe(ctx, target, module, registry, logger)
+		}
+		families := []string{"ip4", "ip6"}
+		if ip := net.ParseIP(host); ip != nil {
+			// A literal address has a single family.
+			families = []string{"ip6"}
+			if ip.To4() != nil {
+				families = []string{"ip4"}
+			}
+		}
+		registry.MustRegister(probeIPFamilySuccessGaugeVec)
+
+		results := make([]bool, len(families))
+		var wg sync.WaitGroup
+		for i, family := range families {
+			familyModule := module
+			protocol, fallback := moduleIPProtocol(&familyModule)
+			*protocol, *fallback = family, false
+			familyRegistry := prometheus.NewRegistry()
+			registry.MustRegister(&labelledCollector{gatherer: familyRegistry, name: "ip_family", value: family})
+			wg.Add(1)
+			go func(i int, family string) {
+				defer wg.Done()
+				familyLogger := log.With(logger, "ip_family", family)
+				results[i] = probe(ctx, target, familyModule, familyRegistry, familyLogger)
+				if results[i] {
+					level.Info(familyLogger).Log("msg", "Probe over IP family succeeded")
+				} else {
+					level.Error(familyLogger).Log("msg", "Probe over IP family failed")
+				}
+			}(i, family)
+		}
+		wg.Wait()
+
+		for i, family := range families {
+			if results[i] {
+				probeIPFamilySuccessGaugeVec.WithLabelValues(family).Set(1)
+			} else {
+				probeIPFamilySuccessGaugeVec.WithLabelValues(family).Set(0)
+			}
+		}
+		return successByPolicy(module.SuccessPolicy, results)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestSuccessByPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		results  []bool
+		expected bool
+	}{
+		{"", []bool{true, true}, true},
+		{"all", []bool{true, false}, false},
+		{"all", nil, false},
+		{"any", []bool{false, true}, true},
+		{"any", []bool{false, false}, false},
+		{"quorum", []bool{true, true, false}, true},
+		{"quorum", []bool{true, false}, false},
+	}
+	for i, test := range tests {
+		if got := successByPolicy(test.policy, test.results); got != test.expected {
+			t.Errorf("Test %d: expected %v for policy %q, got %v", i, test.expected, test.policy, got)
+		}
+	}
+}
+
+func TestProbeAllAddresses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Only Linux routes all of 127.0.0.0/8 to the loopback interface.")
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for policy, expected := range map[string]bool{"all": false, "any": true, "quorum": false} {
+		testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		module := config.Module{
+			Prober:            "tcp",
+			ProbeAllAddresses: true,
+			SuccessPolicy:     policy,
+			Resolver:          config.Resolver{Overrides: map[string][]string{"backend.example": {"127.0.0.1", "127.0.0.2"}}},
+			TCP:               config.TCPProbe{IPProtocol: "ip4"},
+		}
+		registry := prometheus.NewRegistry()
+		if got := ProbeAllAddresses(ProbeTCP)(testCTX, net.JoinHostPort("backend.example", port), module, registry, log.NewNopLogger()); got != expected {
+			t.Fatalf("Policy %q: expected %v, got %v", policy, expected, got)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := map[string]float64{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				if mf.GetName() != "probe_address_success" && mf.GetName() != "probe_ip_protocol" {
+					continue
+				}
+				results[mf.GetName()+"/"+m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+		for name, value := range map[string]float64{
+			"probe_address_success/127.0.0.1": 1,
+			"probe_address_success/127.0.0.2": 0,
+			"probe_ip_protocol/127.0.0.1":     4,
+			"probe_ip_protocol/127.0.0.2":     4,
+		} {
+			if results[name] != value {
+				t.Errorf("Policy %q: expected %s to be %v, got %v", policy, name, value, results[name])
+			}
+		}
+	}
+}
+
+func TestProbeDualStack(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for policy, expected := range map[string]bool{"all": false, "any": true} {
+		testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		module := config.Module{
+			Prober:        "tcp",
+			DualStack:     true,
+			SuccessPolicy: policy,
+			// The target has no IPv6 address.
+			Resolver: config.Resolver{Overrides: map[string][]string{"backend.example": {"127.0.0.1"}}},
+		}
+		registry := prometheus.NewRegistry()
+		if got := ProbeDualStack(ProbeTCP)(testCTX, net.JoinHostPort("backend.example", port), module, registry, log.NewNopLogger()); got != expected {
+			t.Fatalf("Policy %q: expected %v, got %v", policy, expected, got)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := map[string]float64{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				if mf.GetName() != "probe_ip_family_success" && mf.GetName() != "probe_ip_protocol" {
+					continue
+				}
+				results[mf.GetName()+"/"+m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+		for name, value := range map[string]float64{
+			"probe_ip_family_success/ip4": 1,
+			"probe_ip_family_success/ip6": 0,
+			"probe_ip_protocol/ip4":       4,
+		} {
+			if results[name] != value {
+				t.Errorf("Policy %q: expected %s to be %v, got %v", policy, name, value, results[name])
+			}
+		}
+	}
+}
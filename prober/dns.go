@@ -15,8 +15,10 @@ package prober
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -28,6 +30,42 @@ import (
 	"github.com/prometheus/blackbox_exporter/config"
 )
 
+// exchangeThroughProxy works like client.Exchange over TCP, with the
+// connection opened through the proxy dialer of the module.
+func exchangeThroughProxy(ctx context.Context, module config.Module, client *dns.Client, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	dialer := client.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := moduleDialContext(module, dialer)(ctx, strings.TrimSuffix(client.Net, "-tls"), address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, 0, err
+	}
+	if client.TLSConfig != nil {
+		tlsConn := tls.Client(conn, client.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, 0, err
+		}
+		conn = tlsConn
+	}
+
+	co := &dns.Conn{Conn: conn}
+	start := time.Now()
+	if err := co.WriteMsg(msg); err != nil {
+		return nil, 0, err
+	}
+	r, err := co.ReadMsg()
+	if err == nil && r.Id != msg.Id {
+		err = dns.ErrId
+	}
+	return r, time.Since(start), err
+}
+
 // validRRs checks a slice of RRs received from the server against a DNSRRValidator.
 func validRRs(rrs *[]dns.RR, v *config.DNSRRValidator, logger log.Logger) bool {
 	var anyMatch bool = false
@@ -124,6 +162,31 @@ func validRcode(rcode int, valid []string, logger log.Logger) bool {
 	return false
 }
 
+// validFlags checks the header flags of the response against the assertions
+// configured for the module.
+func validFlags(response *dns.Msg, probe config.DNSProbe, logger log.Logger) bool {
+	if probe.FailIfNotAuthoritative && !response.Authoritative {
+		level.Error(logger).Log("msg", "Response is not authoritative")
+		return false
+	}
+	if probe.FailIfRecursionUnavailable && !response.RecursionAvailable {
+		level.Error(logger).Log("msg", "Recursion is not available")
+		return false
+	}
+	if probe.FailIfTruncated && response.Truncated {
+		level.Error(logger).Log("msg", "Response is truncated")
+		return false
+	}
+	return true
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func ProbeDNS(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
 	var dialProtocol string
 	probeDNSDurationGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -142,6 +205,14 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 		Name: "probe_dns_additional_rrs",
 		Help: "Returns number of entries in the additional resource record list",
 	})
+	probeDNSRcodeGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_dns_rcode",
+		Help: "Returns the response code of the DNS response",
+	})
+	probeDNSFlagGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_dns_response_flag",
+		Help: "Indicates whether a header flag is set in the DNS response",
+	}, []string{"flag"})
 
 	for _, lv := range []string{"resolve", "connect", "request"} {
 		probeDNSDurationGaugeVec.WithLabelValues(lv)
@@ -173,7 +244,6 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 	}
 	var probeDNSSOAGauge prometheus.Gauge
 
-	var ip *net.IPAddr
 	if module.DNS.TransportProtocol == "" {
 		module.DNS.TransportProtocol = "udp"
 	}
@@ -181,6 +251,10 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 		level.Error(logger).Log("msg", "Configuration error: Expected transport protocol udp or tcp", "protocol", module.DNS.TransportProtocol)
 		return false
 	}
+	if module.ProxyDialer.URL.URL != nil && module.DNS.TransportProtocol != "tcp" {
+		level.Error(logger).Log("msg", "Configuration error: Expected transport protocol tcp with a proxy dialer", "protocol", module.DNS.TransportProtocol)
+		return false
+	}
 
 	targetAddr, port, err := net.SplitHostPort(target)
 	if err != nil {
@@ -192,18 +266,26 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 		}
 		targetAddr = target
 	}
-	ip, lookupTime, err := chooseProtocol(ctx, module.DNS.IPProtocol, module.DNS.IPProtocolFallback, targetAddr, registry, logger)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error resolving address", "err", err)
-		return false
-	}
-	probeDNSDurationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
-	targetIP := net.JoinHostPort(ip.String(), port)
-
-	if ip.IP.To4() == nil {
-		dialProtocol = module.DNS.TransportProtocol + "6"
+	var targetIP string
+	if module.ProxyDialer.URL.URL != nil {
+		// The proxy resolves the target, whose name might only be known
+		// behind it.
+		targetIP = net.JoinHostPort(targetAddr, port)
+		dialProtocol = module.DNS.TransportProtocol
 	} else {
-		dialProtocol = module.DNS.TransportProtocol + "4"
+		ip, lookupTime, err := chooseProtocol(ctx, module.Resolver, module.DNS.IPProtocol, module.DNS.IPProtocolFallback, targetAddr, registry, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error resolving address", "err", err)
+			return false
+		}
+		probeDNSDurationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
+		targetIP = net.JoinHostPort(ip.String(), port)
+
+		if ip.IP.To4() == nil {
+			dialProtocol = module.DNS.TransportProtocol + "6"
+		} else {
+			dialProtocol = module.DNS.TransportProtocol + "4"
+		}
 	}
 
 	if module.DNS.DNSOverTLS {
@@ -247,10 +329,17 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 			client.Dialer.LocalAddr = &net.UDPAddr{IP: srcIP}
 		}
 	}
+	if len(module.DNS.SourceInterface) > 0 {
+		level.Info(logger).Log("msg", "Using source interface", "interface", module.DNS.SourceInterface)
+		if client.Dialer == nil {
+			client.Dialer = &net.Dialer{}
+		}
+		client.Dialer.Control = bindToDeviceControl(module.DNS.SourceInterface)
+	}
 
 	msg := new(dns.Msg)
 	msg.Id = dns.Id()
-	msg.RecursionDesired = true
+	msg.RecursionDesired = module.DNS.Recursion == nil || *module.DNS.Recursion
 	msg.Question = make([]dns.Question, 1)
 	msg.Question[0] = dns.Question{dns.Fqdn(module.DNS.QueryName), qt, qc}
 
@@ -258,7 +347,15 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 	timeoutDeadline, _ := ctx.Deadline()
 	client.Timeout = time.Until(timeoutDeadline)
 	requestStart := time.Now()
-	response, rtt, err := client.Exchange(msg, targetIP)
+	var (
+		response *dns.Msg
+		rtt      time.Duration
+	)
+	if module.ProxyDialer.URL.URL != nil {
+		response, rtt, err = exchangeThroughProxy(ctx, module, client, msg, targetIP)
+	} else {
+		response, rtt, err = client.Exchange(msg, targetIP)
+	}
 	// The rtt value returned from client.Exchange includes only the time to
 	// exchange messages with the server _after_ the connection is created.
 	// We compute the connection time as the total time for the operation
@@ -267,6 +364,7 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 	probeDNSDurationGaugeVec.WithLabelValues("request").Set(rtt.Seconds())
 	if err != nil {
 		level.Error(logger).Log("msg", "Error while sending a DNS query", "err", err)
+		recordError(ctx, err)
 		return false
 	}
 	level.Info(logger).Log("msg", "Got response", "response", response)
@@ -274,6 +372,13 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 	probeDNSAnswerRRSGauge.Set(float64(len(response.Answer)))
 	probeDNSAuthorityRRSGauge.Set(float64(len(response.Ns)))
 	probeDNSAdditionalRRSGauge.Set(float64(len(response.Extra)))
+	registry.MustRegister(probeDNSRcodeGauge, probeDNSFlagGaugeVec)
+	probeDNSRcodeGauge.Set(float64(response.Rcode))
+	probeDNSFlagGaugeVec.WithLabelValues("aa").Set(boolToFloat(response.Authoritative))
+	probeDNSFlagGaugeVec.WithLabelValues("tc").Set(boolToFloat(response.Truncated))
+	probeDNSFlagGaugeVec.WithLabelValues("ra").Set(boolToFloat(response.RecursionAvailable))
+	probeDNSFlagGaugeVec.WithLabelValues("ad").Set(boolToFloat(response.AuthenticatedData))
+	probeDNSFlagGaugeVec.WithLabelValues("cd").Set(boolToFloat(response.CheckingDisabled))
 
 	if qt == dns.TypeSOA {
 		probeDNSSOAGauge = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -292,6 +397,9 @@ func ProbeDNS(ctx context.Context, target string, module config.Module, registry
 	if !validRcode(response.Rcode, module.DNS.ValidRcodes, logger) {
 		return false
 	}
+	if !validFlags(response, module.DNS, logger) {
+		return false
+	}
 	level.Info(logger).Log("msg", "Validating Answer RRs")
 	if !validRRs(&response.Answer, &module.DNS.ValidateAnswer, logger) {
 		level.Error(logger).Log("msg", "Answer RRs validation failed")
@@ -375,6 +375,94 @@ func TestAuthoritativeDNSResponse(t *testing.T) {
 	}
 }
 
+// flagsDNSHandler answers authoritatively only for iterative queries, and
+// advertises recursion only for recursive ones.
+func flagsDNSHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = !r.RecursionDesired
+	m.RecursionAvailable = r.RecursionDesired
+	a, err := dns.NewRR("example.com. 3600 IN A 127.0.0.1")
+	if err != nil {
+		panic(err)
+	}
+	m.Answer = append(m.Answer, a)
+	if err := w.WriteMsg(m); err != nil {
+		panic(err)
+	}
+}
+
+func TestDNSResponseFlags(t *testing.T) {
+	noRecursion := false
+	tests := []struct {
+		Probe         config.DNSProbe
+		ShouldSucceed bool
+		ExpectedFlags map[string]float64
+	}{
+		{
+			config.DNSProbe{
+				IPProtocol:             "ip4",
+				QueryName:              "example.com",
+				FailIfNotAuthoritative: true,
+			}, false, map[string]float64{"aa": 0, "ra": 1},
+		},
+		{
+			config.DNSProbe{
+				IPProtocol:             "ip4",
+				QueryName:              "example.com",
+				Recursion:              &noRecursion,
+				FailIfNotAuthoritative: true,
+			}, true, map[string]float64{"aa": 1, "ra": 0},
+		},
+		{
+			config.DNSProbe{
+				IPProtocol:                 "ip4",
+				QueryName:                  "example.com",
+				Recursion:                  &noRecursion,
+				FailIfRecursionUnavailable: true,
+			}, false, map[string]float64{"aa": 1, "ra": 0},
+		},
+		{
+			config.DNSProbe{
+				IPProtocol:                 "ip4",
+				QueryName:                  "example.com",
+				FailIfRecursionUnavailable: true,
+				FailIfTruncated:            true,
+			}, true, map[string]float64{"aa": 0, "ra": 1, "tc": 0},
+		},
+	}
+
+	server, addr := startDNSServer("udp", flagsDNSHandler)
+	defer server.Shutdown()
+	_, port, _ := net.SplitHostPort(addr.String())
+
+	for i, test := range tests {
+		registry := prometheus.NewRegistry()
+		testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		result := ProbeDNS(testCTX, net.JoinHostPort("127.0.0.1", port), config.Module{Timeout: time.Second, DNS: test.Probe}, registry, log.NewNopLogger())
+		if result != test.ShouldSucceed {
+			t.Fatalf("Test %d had unexpected result: %v", i, result)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRegistryResults(map[string]float64{"probe_dns_rcode": 0}, mfs, t)
+		for _, mf := range mfs {
+			if mf.GetName() != "probe_dns_response_flag" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				flag := m.GetLabel()[0].GetValue()
+				if exp, ok := test.ExpectedFlags[flag]; ok && m.GetGauge().GetValue() != exp {
+					t.Fatalf("Test %d: expected flag %s to be %v, got %v", i, flag, exp, m.GetGauge().GetValue())
+				}
+			}
+		}
+	}
+}
+
 func TestServfailDNSResponse(t *testing.T) {
 	if os.Getenv("TRAVIS") == "true" {
 		t.Skip("skipping; travisci is failing on ipv6 dns requests")
@@ -612,6 +700,16 @@ func TestDNSMetrics(t *testing.T) {
 		"probe_dns_answer_rrs":     nil,
 		"probe_dns_authority_rrs":  nil,
 		"probe_dns_additional_rrs": nil,
+		"probe_dns_rcode":          nil,
+		"probe_dns_response_flag": {
+			"flag": {
+				"aa": {},
+				"tc": {},
+				"ra": {},
+				"ad": {},
+				"cd": {},
+			},
+		},
 	}
 
 	checkMetrics(expectedMetrics, mfs, t)
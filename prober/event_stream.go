@@ -0,0 +1,200 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+type serverSentEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// scanEventStreamLines splits lines ending in CRLF, LF or CR.
+func scanEventStreamLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		// Wait for the next byte, which may be the LF of a CRLF.
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// eventStreamReader parses a text/event-stream as specified by the HTML
+// standard.
+type eventStreamReader struct {
+	scanner     *bufio.Scanner
+	lastEventID string
+}
+
+func newEventStreamReader(r io.Reader) *eventStreamReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanEventStreamLines)
+	return &eventStreamReader{scanner: scanner}
+}
+
+// next returns the next event, or io.EOF at the end of the stream.
+func (r *eventStreamReader) next() (serverSentEvent, error) {
+	var (
+		event   string
+		data    strings.Builder
+		hasData bool
+	)
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if line == "" {
+			if !hasData {
+				event = ""
+				continue
+			}
+			if event == "" {
+				event = "message"
+			}
+			return serverSentEvent{
+				id:    r.lastEventID,
+				event: event,
+				data:  strings.TrimSuffix(data.String(), "\n"),
+			}, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteString("\n")
+			hasData = true
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				r.lastEventID = value
+			}
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return serverSentEvent{}, err
+	}
+	return serverSentEvent{}, io.EOF
+}
+
+// probeEventStream reads events from the response until the configured
+// number of events was received and, if set, one of them matched.
+func probeEventStream(resp *http.Response, body io.Reader, cfg config.HTTPEventStream, start time.Time, probeFailedDueToRegex prometheus.Gauge, registry *prometheus.Registry, logger log.Logger) bool {
+	var (
+		timeToFirstEventGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_event_stream_time_to_first_event_seconds",
+			Help: "Time from the start of the request to the first event",
+		})
+		eventsReceivedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_event_stream_events_received",
+			Help: "Number of events received",
+		})
+		lastEventIDGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_http_event_stream_last_event_id_info",
+			Help: "Contains the last event ID received",
+		}, []string{"last_event_id"})
+	)
+	registry.MustRegister(timeToFirstEventGauge, eventsReceivedGauge)
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		level.Error(logger).Log("msg", "Response is not an event stream", "content_type", resp.Header.Get("Content-Type"))
+		return false
+	}
+
+	var re *regexp.Regexp
+	if cfg.Expect != "" {
+		var err error
+		if re, err = regexp.Compile(cfg.Expect); err != nil {
+			level.Error(logger).Log("msg", "Could not compile into regular expression", "regexp", cfg.Expect, "err", err)
+			return false
+		}
+	}
+	wanted := cfg.Events
+	if wanted == 0 {
+		wanted = 1
+	}
+
+	reader := newEventStreamReader(body)
+	received := 0
+	matched := re == nil
+	defer func() {
+		if reader.lastEventID != "" {
+			registry.MustRegister(lastEventIDGaugeVec)
+			lastEventIDGaugeVec.WithLabelValues(reader.lastEventID).Set(1)
+		}
+	}()
+	for received < wanted || !matched {
+		event, err := reader.next()
+		if err != nil {
+			if re != nil && !matched {
+				probeFailedDueToRegex.Set(1)
+			}
+			level.Error(logger).Log("msg", "Error reading event stream", "events_received", received, "err", err)
+			return false
+		}
+		if cfg.Event != "" && event.event != cfg.Event {
+			continue
+		}
+		if received == 0 {
+			timeToFirstEventGauge.Set(time.Since(start).Seconds())
+		}
+		received++
+		eventsReceivedGauge.Set(float64(received))
+		level.Debug(logger).Log("msg", "Received event", "id", event.id, "event", event.event, "data", event.data)
+		if re != nil && !matched && re.MatchString(event.data) {
+			level.Info(logger).Log("msg", "Event matched", "regexp", re, "id", event.id)
+			matched = true
+			probeFailedDueToRegex.Set(0)
+		}
+	}
+	level.Info(logger).Log("msg", "Received events", "events_received", received)
+	return true
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestEventStreamReader(t *testing.T) {
+	stream := ": comment\r\n" +
+		"retry: 1000\r\n\r\n" +
+		"id: 1\ndata: first\ndata:  line\n\n" +
+		"event: update\rdata\r\r" +
+		"id: 2\nevent: update\ndata: third\n\n" +
+		"data: unterminated"
+	expected := []serverSentEvent{
+		{id: "1", event: "message", data: "first\n line"},
+		{id: "1", event: "update", data: ""},
+		{id: "2", event: "update", data: "third"},
+	}
+	reader := newEventStreamReader(strings.NewReader(stream))
+	for i, want := range expected {
+		got, err := reader.next()
+		if err != nil {
+			t.Fatalf("Event %d: unexpected error: %s", i, err)
+		}
+		if got != want {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+	if _, err := reader.next(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestHTTPEventStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		if r.URL.Path == "/plain" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "data: hello\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "id: %d\nevent: tick\ndata: tick %d\n\n", i, i)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, ": keepalive\n\n")
+		w.(http.Flusher).Flush()
+		// Keep the stream open, as a real server would.
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		path        string
+		eventStream config.HTTPEventStream
+		success     bool
+		results     map[string]float64
+		lastEventID string
+	}{
+		{eventStream: config.HTTPEventStream{Events: 2}, success: true, lastEventID: "2",
+			results: map[string]float64{"probe_http_event_stream_events_received": 2}},
+		{eventStream: config.HTTPEventStream{Expect: "tick 3"}, success: true, lastEventID: "3",
+			results: map[string]float64{"probe_http_event_stream_events_received": 3, "probe_failed_due_to_regex": 0}},
+		{eventStream: config.HTTPEventStream{Events: 1, Event: "tick"}, success: true, lastEventID: "1",
+			results: map[string]float64{"probe_http_event_stream_events_received": 1}},
+		{eventStream: config.HTTPEventStream{Events: 1, Event: "other"}, success: false, lastEventID: "3",
+			results: map[string]float64{"probe_http_event_stream_events_received": 0}},
+		{eventStream: config.HTTPEventStream{Expect: "tock"}, success: false, lastEventID: "3",
+			results: map[string]float64{"probe_http_event_stream_events_received": 3, "probe_failed_due_to_regex": 1}},
+		{path: "/plain", eventStream: config.HTTPEventStream{Events: 1}, success: false},
+	}
+	for i, test := range tests {
+		module := config.Module{
+			Timeout: time.Second,
+			HTTP: config.HTTPProbe{
+				IPProtocolFallback: true,
+				EventStream:        test.eventStream,
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		registry := prometheus.NewRegistry()
+		success := ProbeHTTP(testCTX, ts.URL+test.path, module, registry, log.NewNopLogger())
+		cancel()
+		if success != test.success {
+			t.Fatalf("Test %d: expected success %v, got %v", i, test.success, success)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRegistryResults(test.results, mfs, t)
+		lastEventID := ""
+		for _, mf := range mfs {
+			if mf.GetName() == "probe_http_event_stream_last_event_id_info" {
+				lastEventID = mf.GetMetric()[0].GetLabel()[0].GetValue()
+			}
+		}
+		if lastEventID != test.lastEventID {
+			t.Errorf("Test %d: expected last event ID %q, got %q", i, test.lastEventID, lastEventID)
+		}
+	}
+}
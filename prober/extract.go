@@ -0,0 +1,121 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// metricExtractor turns the named groups of regexp matches in responses
+// into gauges, which are registered once the probe is done.
+type metricExtractor struct {
+	logger     log.Logger
+	gauges     map[string]*prometheus.GaugeVec
+	labelNames map[string][]string
+}
+
+func newMetricExtractor(logger log.Logger) *metricExtractor {
+	return &metricExtractor{
+		logger:     logger,
+		gauges:     map[string]*prometheus.GaugeVec{},
+		labelNames: map[string][]string{},
+	}
+}
+
+// extract sets the gauges of m for every match of its regexp in data.
+func (e *metricExtractor) extract(m config.MetricExtraction, data []byte) error {
+	re, err := regexp.Compile(m.Regexp)
+	if err != nil {
+		return err
+	}
+	for _, match := range re.FindAllSubmatchIndex(data, -1) {
+		e.add(m, re, data, match)
+	}
+	return nil
+}
+
+// add sets the gauge of m for a single match of re in data, as returned by
+// re.FindSubmatchIndex.
+func (e *metricExtractor) add(m config.MetricExtraction, re *regexp.Regexp, data []byte, match []int) {
+	valueGroup := m.ValueGroup
+	if valueGroup == "" {
+		valueGroup = "value"
+	}
+	var value []byte
+	for i, name := range re.SubexpNames() {
+		if name == valueGroup && match[2*i] >= 0 {
+			value = data[match[2*i]:match[2*i+1]]
+		}
+	}
+	if value == nil {
+		level.Debug(e.logger).Log("msg", "Value group did not match", "regexp", re, "value_group", valueGroup)
+		return
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+	if err != nil {
+		level.Debug(e.logger).Log("msg", "Extracted value is not a number", "value", string(value), "err", err)
+		return
+	}
+
+	name := string(re.Expand(nil, []byte(m.Name), data, match))
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		level.Warn(e.logger).Log("msg", "Extracted metric name is not valid", "name", name)
+		return
+	}
+	labelNames := make([]string, 0, len(m.Labels))
+	for ln := range m.Labels {
+		labelNames = append(labelNames, ln)
+	}
+	sort.Strings(labelNames)
+
+	gauge, ok := e.gauges[name]
+	if !ok {
+		help := m.Help
+		if help == "" {
+			help = "Extracted from the probe response"
+		}
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)
+		e.gauges[name] = gauge
+		e.labelNames[name] = labelNames
+	} else if strings.Join(e.labelNames[name], ",") != strings.Join(labelNames, ",") {
+		level.Warn(e.logger).Log("msg", "Extracted metric has inconsistent label names", "name", name)
+		return
+	}
+
+	labelValues := make([]string, len(labelNames))
+	for i, ln := range labelNames {
+		labelValues[i] = string(re.Expand(nil, []byte(m.Labels[ln]), data, match))
+	}
+	gauge.WithLabelValues(labelValues...).Set(v)
+}
+
+// register registers the extracted gauges, except those clashing with the
+// probe's own metrics.
+func (e *metricExtractor) register(registry *prometheus.Registry) {
+	for name, gauge := range e.gauges {
+		if err := registry.Register(gauge); err != nil {
+			level.Warn(e.logger).Log("msg", "Error registering extracted metric", "name", name, "err", err)
+		}
+	}
+}
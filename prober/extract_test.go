@@ -0,0 +1,201 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestMetricExtractor(t *testing.T) {
+	data := []byte("STAT curr_items 42\nSTAT bytes 1024\nSTAT version 1.6.9\nSTAT probe_success 0\nEND\n")
+	e := newMetricExtractor(log.NewNopLogger())
+	extractions := []config.MetricExtraction{
+		{
+			// The version is not a number and skipped.
+			Name:   "memcached_${key}",
+			Regexp: `(?m)^STAT (?P<key>\w+) (?P<value>\S+)$`,
+		},
+		{
+			Name:       "memcached_stat",
+			Regexp:     `(?m)^STAT (?P<key>\w+) (?P<count>\d+)$`,
+			ValueGroup: "count",
+			Labels:     map[string]string{"stat": "${key}", "server": "test"},
+		},
+		{
+			// Clashes with the probe's own metrics.
+			Name:   "${key}",
+			Regexp: `(?m)^STAT (?P<key>probe_success) (?P<value>\d+)$`,
+		},
+	}
+	for _, m := range extractions {
+		if err := e.extract(m, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{Name: "probe_success", Help: "Displays whether or not the probe was a success"})
+	probeSuccess.Set(1)
+	registry.MustRegister(probeSuccess)
+	e.register(registry)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResults := map[string]float64{
+		"memcached_curr_items": 42,
+		"memcached_bytes":      1024,
+		"probe_success":        1,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+	expectedMetrics := map[string]map[string]map[string]struct{}{
+		"memcached_stat": {
+			"stat": {"curr_items": {}, "bytes": {}, "probe_success": {}},
+		},
+	}
+	checkMetrics(expectedMetrics, mfs, t)
+	for _, mf := range mfs {
+		if mf.GetName() == "memcached_version" {
+			t.Fatalf("Expected non-numeric values to be skipped")
+		}
+	}
+}
+
+func TestTCPMetricExtraction(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(1 * time.Second))
+		fmt.Fprintf(conn, "zk_version\t3.5.8\nzk_avg_latency\t3\nzk_num_alive_connections\t7\nzk_outstanding_requests\t2\nzk_server_state\tleader\n")
+	}()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocolFallback: true,
+			QueryResponse: []config.QueryResponse{
+				{
+					Expect: `^zk_num_alive_connections\t(?P<value>\d+)`,
+					Metrics: []config.MetricExtraction{
+						{
+							// Uses the captures of expect.
+							Name: "zk_alive_connections",
+						},
+						{
+							// Applies to the lines read up to the match.
+							Name:   "zk_${key}",
+							Regexp: `(?m)^zk_(?P<key>\w+)\t(?P<value>[0-9.]+)$`,
+						},
+					},
+				},
+				{
+					// Reads the next line only.
+					Metrics: []config.MetricExtraction{
+						{
+							Name:   "zk_outstanding",
+							Regexp: `^zk_outstanding_requests\t(?P<value>\d+)$`,
+						},
+					},
+				},
+			},
+		},
+	}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !ProbeTCP(testCTX, ln.Addr().String(), module, registry, log.NewNopLogger()) {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResults := map[string]float64{
+		"zk_alive_connections":     7,
+		"zk_avg_latency":           3,
+		"zk_num_alive_connections": 7,
+		"zk_outstanding":           2,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+	for _, mf := range mfs {
+		if mf.GetName() == "zk_version" || mf.GetName() == "zk_server_state" || mf.GetName() == "zk_outstanding_requests" {
+			t.Fatalf("Unexpected metric %s", mf.GetName())
+		}
+	}
+}
+
+func TestHTTPMetricExtraction(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Active connections: 291\nReading: 6 Writing: 179 Waiting: 106\n")
+	}))
+	defer ts.Close()
+
+	module := config.Module{
+		HTTP: config.HTTPProbe{
+			IPProtocolFallback:         true,
+			FailIfBodyNotMatchesRegexp: []string{"Active connections"},
+			Metrics: []config.MetricExtraction{
+				{
+					Name:   "nginx_connections_active",
+					Regexp: `Active connections: (?P<value>\d+)`,
+				},
+				{
+					Name:   "nginx_connections",
+					Regexp: `(?P<state>Reading|Writing|Waiting): (?P<value>\d+)`,
+					Labels: map[string]string{"state": "${state}"},
+				},
+			},
+		},
+	}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !ProbeHTTP(testCTX, ts.URL, module, registry, log.NewNopLogger()) {
+		t.Fatalf("HTTP module failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResults := map[string]float64{
+		"nginx_connections_active":  291,
+		"probe_failed_due_to_regex": 0,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+	expectedMetrics := map[string]map[string]map[string]struct{}{
+		"nginx_connections": {
+			"state": {"Reading": {}, "Writing": {}, "Waiting": {}},
+		},
+	}
+	checkMetrics(expectedMetrics, mfs, t)
+}
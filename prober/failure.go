@@ -0,0 +1,76 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Classes of probe failures, as matched by expected_failure_classes.
+const (
+	FailureRefused      = "refused"
+	FailureTimeout      = "timeout"
+	FailureTLSHandshake = "tls_handshake"
+	FailureStatus       = "status"
+)
+
+// FailureRecorder keeps the class of the first failure a probe recorded.
+type FailureRecorder struct {
+	mu    sync.Mutex
+	class string
+}
+
+// Class returns the recorded failure class, or an empty string.
+func (f *FailureRecorder) Class() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.class
+}
+
+type failureRecorderKey struct{}
+
+// WithFailureRecorder returns a context in which probes record the class of
+// their failure.
+func WithFailureRecorder(ctx context.Context) (context.Context, *FailureRecorder) {
+	f := &FailureRecorder{}
+	return context.WithValue(ctx, failureRecorderKey{}, f), f
+}
+
+// recordFailure records the failure class, unless one was already recorded.
+func recordFailure(ctx context.Context, class string) {
+	f, ok := ctx.Value(failureRecorderKey{}).(*FailureRecorder)
+	if !ok || class == "" {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.class == "" {
+		f.class = class
+	}
+}
+
+// recordError records the failure class of a network error, if it has one.
+func recordError(ctx context.Context, err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		recordFailure(ctx, FailureRefused)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		recordFailure(ctx, FailureTimeout)
+	}
+}
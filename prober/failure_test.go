@@ -0,0 +1,90 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestTCPFailureClasses(t *testing.T) {
+	// A port nobody listens on.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	// A server that never answers.
+	silent, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// A server that closes connections right away.
+	closing, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer closing.Close()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		target string
+		tcp    config.TCPProbe
+		class  string
+	}{
+		{target: closedAddr, class: FailureRefused},
+		{target: silent.Addr().String(), tcp: config.TCPProbe{QueryResponse: []config.QueryResponse{{Expect: "^hello"}}}, class: FailureTimeout},
+		{target: closing.Addr().String(), tcp: config.TCPProbe{TLS: true}, class: FailureTLSHandshake},
+	}
+	for i, test := range tests {
+		test.tcp.IPProtocol = "ip4"
+		testCTX, cancel := context.WithTimeout(context.Background(), time.Second)
+		ctx, failure := WithFailureRecorder(testCTX)
+		if ProbeTCP(ctx, test.target, config.Module{TCP: test.tcp}, prometheus.NewRegistry(), log.NewNopLogger()) {
+			t.Errorf("Test %d: TCP module succeeded, expected failure.", i)
+		}
+		cancel()
+		if class := failure.Class(); class != test.class {
+			t.Errorf("Test %d: expected failure class %q, got %q", i, test.class, class)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// grpcServingStatuses are the values of the status enum of
+// grpc.health.v1.HealthCheckResponse.
+var grpcServingStatuses = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+const grpcServing = 1
+
+// grpcFrame prefixes an uncompressed message with its length, as in the body
+// of gRPC requests and responses.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseHealthCheckResponse returns the serving status of a framed
+// HealthCheckResponse.
+func parseHealthCheckResponse(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 0, errors.New("response message is truncated")
+	}
+	if b[0] != 0 {
+		return 0, errors.New("response message is compressed")
+	}
+	length := binary.BigEndian.Uint32(b[1:5])
+	if uint32(len(b)-5) < length {
+		return 0, errors.New("response message is truncated")
+	}
+	msg := b[5 : 5+length]
+	status := 0
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			status = int(v)
+			msg = msg[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return status, nil
+}
+
+func ProbeGRPC(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	var (
+		durationGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_grpc_duration_seconds",
+			Help: "Duration of gRPC health check by phase",
+		}, []string{"phase"})
+		statusCodeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_grpc_status_code",
+			Help: "Response gRPC status code",
+		})
+		servingStatusGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_grpc_healthcheck_response",
+			Help: "Serving status of the health check response",
+		}, []string{"serving_status"})
+		probeSSLEarliestCertExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ssl_earliest_cert_expiry",
+			Help: "Returns earliest SSL cert expiry date",
+		})
+		probeSSLLastChainExpiryTimestampSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ssl_last_chain_expiry_timestamp_seconds",
+			Help: "Returns last SSL chain expiry in unixtime",
+		})
+		probeSSLLastInformation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_ssl_last_chain_info",
+			Help: "Contains SSL leaf certificate information",
+		}, []string{"fingerprint_sha256"})
+		probeTLSVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_tls_version_info",
+			Help: "Returns the TLS version used, or NaN when unknown",
+		}, []string{"version"})
+	)
+	for _, lv := range []string{"resolve", "connect", "tls", "check"} {
+		durationGaugeVec.WithLabelValues(lv)
+	}
+	registry.MustRegister(durationGaugeVec, statusCodeGauge, servingStatusGaugeVec)
+
+	targetAddress, port, err := net.SplitHostPort(target)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error splitting target address and port", "err", err)
+		return false
+	}
+	ip, lookupTime, err := chooseProtocol(ctx, module.Resolver, module.GRPC.IPProtocol, module.GRPC.IPProtocolFallback, targetAddress, registry, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error resolving address", "err", err)
+		return false
+	}
+	durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
+
+	connectStart := time.Now()
+	conn, err := moduleDialContext(module, &net.Dialer{})(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	durationGaugeVec.WithLabelValues("connect").Add(time.Since(connectStart).Seconds())
+	if err != nil {
+		level.Error(logger).Log("msg", "Error dialing gRPC server", "err", err)
+		recordError(ctx, err)
+		return false
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		level.Error(logger).Log("msg", "Error setting deadline", "err", err)
+		return false
+	}
+
+	scheme := "http"
+	if module.GRPC.TLS {
+		scheme = "https"
+		tlsConfig, err := pconfig.NewTLSConfig(&module.GRPC.TLSConfig)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating TLS configuration", "err", err)
+			return false
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = targetAddress
+		}
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsStart := time.Now()
+		err = tlsConn.Handshake()
+		durationGaugeVec.WithLabelValues("tls").Add(time.Since(tlsStart).Seconds())
+		if err != nil {
+			level.Error(logger).Log("msg", "TLS Handshake (client) failed", "err", err)
+			recordFailure(ctx, FailureTLSHandshake)
+			return false
+		}
+		state := tlsConn.ConnectionState()
+		registry.MustRegister(probeSSLEarliestCertExpiry, probeTLSVersion, probeSSLLastChainExpiryTimestampSeconds, probeSSLLastInformation)
+		probeSSLEarliestCertExpiry.Set(float64(getEarliestCertExpiry(&state).Unix()))
+		probeTLSVersion.WithLabelValues(getTLSVersion(&state)).Set(1)
+		probeSSLLastChainExpiryTimestampSeconds.Set(float64(getLastChainExpiry(&state).Unix()))
+		probeSSLLastInformation.WithLabelValues(getFingerprint(&state)).Set(1)
+		if state.NegotiatedProtocol != http2.NextProtoTLS {
+			level.Error(logger).Log("msg", "Server did not negotiate HTTP/2", "protocol", state.NegotiatedProtocol)
+			return false
+		}
+		conn = tlsConn
+	}
+
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error starting HTTP/2 connection", "err", err)
+		return false
+	}
+
+	// HealthCheckRequest has the service name as its first field.
+	msg := protowire.AppendTag(nil, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, module.GRPC.Service)
+	request, err := http.NewRequest("POST", scheme+"://"+target+"/grpc.health.v1.Health/Check", bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating request", "err", err)
+		return false
+	}
+	request = request.WithContext(ctx)
+	for key, value := range module.GRPC.Metadata {
+		request.Header.Set(key, value)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	request.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", time.Until(deadline).Milliseconds()))
+
+	level.Info(logger).Log("msg", "Checking gRPC health", "service", module.GRPC.Service)
+	checkStart := time.Now()
+	resp, err := cc.RoundTrip(request)
+	if err != nil {
+		durationGaugeVec.WithLabelValues("check").Add(time.Since(checkStart).Seconds())
+		level.Error(logger).Log("msg", "Error for gRPC request", "err", err)
+		recordError(ctx, err)
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	durationGaugeVec.WithLabelValues("check").Add(time.Since(checkStart).Seconds())
+	if err != nil {
+		level.Error(logger).Log("msg", "Error reading gRPC response", "err", err)
+		recordError(ctx, err)
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		level.Error(logger).Log("msg", "Invalid HTTP response status code", "status_code", resp.StatusCode)
+		recordFailure(ctx, FailureStatus)
+		return false
+	}
+
+	// Responses without a message carry their status in the headers.
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid gRPC status", "grpc_status", grpcStatus)
+		return false
+	}
+	statusCodeGauge.Set(float64(code))
+	if code != 0 {
+		grpcMessage := resp.Trailer.Get("Grpc-Message")
+		if grpcMessage == "" {
+			grpcMessage = resp.Header.Get("Grpc-Message")
+		}
+		level.Error(logger).Log("msg", "gRPC health check failed", "grpc_status", code, "grpc_message", grpcMessage)
+		recordFailure(ctx, FailureStatus)
+		return false
+	}
+
+	servingStatus, err := parseHealthCheckResponse(body)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing health check response", "err", err)
+		return false
+	}
+	for i, name := range grpcServingStatuses {
+		v := 0.0
+		if i == servingStatus {
+			v = 1
+		}
+		servingStatusGaugeVec.WithLabelValues(name).Set(v)
+	}
+	level.Info(logger).Log("msg", "Received health check response", "serving_status", servingStatus)
+	if servingStatus != grpcServing {
+		recordFailure(ctx, FailureStatus)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// grpcHealthHandler answers health checks with the status configured for
+// the requested service.
+func grpcHealthHandler(t *testing.T, statuses map[string]int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/grpc.health.v1.Health/Check" || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "16")
+			w.Header().Set("Grpc-Message", "unauthenticated")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		service := ""
+		if len(body) > 5 {
+			msg := body[5:]
+			if _, _, n := protowire.ConsumeTag(msg); n > 0 {
+				v, _ := protowire.ConsumeString(msg[n:])
+				service = v
+			}
+		}
+		status, ok := statuses[service]
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		if !ok {
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+		msg := protowire.AppendTag(nil, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(status))
+		w.Write(grpcFrame(msg))
+		w.Header().Set("Grpc-Status", "0")
+	})
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	statuses := map[string]int{"": 1, "frontend": 1, "backend": 2}
+	handler := grpcHealthHandler(t, statuses)
+
+	// Plaintext HTTP/2 with prior knowledge.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		tls     bool
+		service string
+		auth    string
+		serving string
+		success bool
+		results map[string]float64
+	}{
+		{service: "", serving: "SERVING", success: true, results: map[string]float64{"probe_grpc_status_code": 0}},
+		{service: "backend", serving: "NOT_SERVING", success: false, results: map[string]float64{"probe_grpc_status_code": 0}},
+		{service: "unknown", success: false, results: map[string]float64{"probe_grpc_status_code": 5}},
+		{service: "frontend", auth: "Bearer wrong", success: false, results: map[string]float64{"probe_grpc_status_code": 16}},
+		{tls: true, service: "frontend", serving: "SERVING", success: true, results: map[string]float64{"probe_grpc_status_code": 0}},
+	}
+	for i, test := range tests {
+		target := ln.Addr().String()
+		if test.tls {
+			target = strings.TrimPrefix(ts.URL, "https://")
+		}
+		auth := test.auth
+		if auth == "" {
+			auth = "Bearer token"
+		}
+		module := config.Module{
+			GRPC: config.GRPCProbe{
+				IPProtocol: "ip4",
+				Service:    test.service,
+				TLS:        test.tls,
+				TLSConfig:  pconfig.TLSConfig{InsecureSkipVerify: true},
+				Metadata:   map[string]string{"authorization": auth},
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		registry := prometheus.NewRegistry()
+		success := ProbeGRPC(testCTX, target, module, registry, log.NewNopLogger())
+		cancel()
+		if success != test.success {
+			t.Fatalf("Test %d: expected success %v, got %v", i, test.success, success)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRegistryResults(test.results, mfs, t)
+		for _, mf := range mfs {
+			if mf.GetName() != "probe_grpc_healthcheck_response" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				want := 0.0
+				if m.GetLabel()[0].GetValue() == test.serving {
+					want = 1
+				}
+				if got := m.GetGauge().GetValue(); got != want {
+					t.Errorf("Test %d: expected %s %v, got %v", i, m.GetLabel()[0].GetValue(), want, got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// defaultHappyEyeballsAttemptDelay is the Connection Attempt Delay
+// recommended by RFC 8305 section 8.
+const defaultHappyEyeballsAttemptDelay = 250 * time.Millisecond
+
+// sortHappyEyeballs orders addresses as per RFC 8305 section 4, alternating
+// between the IP families starting with the preferred one. Like
+// chooseProtocol, IPv6 is preferred unless IPProtocol is "ip4".
+func sortHappyEyeballs(addrs []net.IPAddr, IPProtocol string) []net.IP {
+	var preferred, other []net.IP
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (IPProtocol == "ip4") {
+			preferred = append(preferred, addr.IP)
+		} else {
+			other = append(other, addr.IP)
+		}
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			ips = append(ips, preferred[i])
+		}
+		if i < len(other) {
+			ips = append(ips, other[i])
+		}
+	}
+	return ips
+}
+
+// happyEyeballsAttempt is a connection attempt to one address.
+type happyEyeballsAttempt struct {
+	ip net.IP
+	// Time after the start of the first attempt.
+	delay       time.Duration
+	connectTime time.Duration
+	err         error
+}
+
+// dialHappyEyeballs connects to the first of ips to accept a connection. As
+// per RFC 8305 section 5, the next address is tried whenever an attempt fails
+// or has not succeeded within attemptDelay, and the remaining attempts are
+// cancelled once one succeeds. It returns after all attempts are done, with
+// the index of the winning attempt.
+func dialHappyEyeballs(ctx context.Context, dial dialContextFunc, ips []net.IP, port string, attemptDelay time.Duration) (net.Conn, int, []happyEyeballsAttempt, error) {
+	if len(ips) == 0 {
+		return nil, -1, nil, errors.New("no addresses to connect to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i           int
+		conn        net.Conn
+		connectTime time.Duration
+		err         error
+	}
+	results := make(chan result)
+	var attempts []happyEyeballsAttempt
+	start := time.Now()
+	startAttempt := func() {
+		i := len(attempts)
+		attempts = append(attempts, happyEyeballsAttempt{ip: ips[i], delay: time.Since(start)})
+		network := "tcp6"
+		if ips[i].To4() != nil {
+			network = "tcp4"
+		}
+		address := net.JoinHostPort(ips[i].String(), port)
+		go func() {
+			attemptStart := time.Now()
+			conn, err := dial(ctx, network, address)
+			results <- result{i: i, conn: conn, connectTime: time.Since(attemptStart), err: err}
+		}()
+	}
+
+	var winner net.Conn
+	winnerIndex := -1
+	var lastErr error
+	startAttempt()
+	pending := 1
+	next := time.After(attemptDelay)
+	for pending > 0 {
+		select {
+		case <-next:
+			if winner == nil && len(attempts) < len(ips) {
+				startAttempt()
+				pending++
+				next = time.After(attemptDelay)
+			}
+		case r := <-results:
+			pending--
+			attempts[r.i].connectTime = r.connectTime
+			attempts[r.i].err = r.err
+			if r.err != nil {
+				lastErr = r.err
+				if winner == nil && len(attempts) < len(ips) {
+					// Do not wait for the delay after a failure.
+					startAttempt()
+					pending++
+					next = time.After(attemptDelay)
+				}
+				continue
+			}
+			if winner != nil {
+				r.conn.Close()
+				continue
+			}
+			winner, winnerIndex = r.conn, r.i
+			cancel()
+		}
+	}
+	if winner == nil {
+		return nil, -1, attempts, lastErr
+	}
+	return winner, winnerIndex, attempts, nil
+}
+
+// happyEyeballs connects to a host by racing its addresses, and exports
+// the attempts made.
+type happyEyeballs struct {
+	ips          []net.IP
+	attemptDelay time.Duration
+	logger       log.Logger
+
+	probeIPProtocolGauge            prometheus.Gauge
+	probeIPAddrHash                 prometheus.Gauge
+	probeAttemptDelayGaugeVec       *prometheus.GaugeVec
+	probeAttemptConnectTimeGaugeVec *prometheus.GaugeVec
+	probeAttemptSuccessGaugeVec     *prometheus.GaugeVec
+}
+
+// newHappyEyeballs resolves all addresses of host, to be tried starting with
+// the IPProtocol family. Like chooseProtocol, it exports the lookup time, and
+// the protocol and hash of the address eventually connected to.
+func newHappyEyeballs(ctx context.Context, rc config.Resolver, host, IPProtocol string, attemptDelay time.Duration, registry *prometheus.Registry, logger log.Logger) (*happyEyeballs, float64, error) {
+	probeDNSLookupTimeSeconds := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_dns_lookup_time_seconds",
+		Help: "Returns the time taken for probe dns lookup in seconds",
+	})
+	h := &happyEyeballs{
+		attemptDelay: attemptDelay,
+		logger:       logger,
+		probeIPProtocolGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ip_protocol",
+			Help: "Specifies whether probe ip protocol is IP4 or IP6",
+		}),
+		probeIPAddrHash: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ip_addr_hash",
+			Help: "Specifies the hash of IP address. It's useful to detect if the IP address changes.",
+		}),
+		probeAttemptDelayGaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_happy_eyeballs_attempt_delay_seconds",
+			Help: "Time between the first connection attempt and this one",
+		}, []string{"attempt", "ip"}),
+		probeAttemptConnectTimeGaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_happy_eyeballs_attempt_connect_seconds",
+			Help: "Duration of a connection attempt until it succeeded, failed or was cancelled",
+		}, []string{"attempt", "ip"}),
+		probeAttemptSuccessGaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_happy_eyeballs_attempt_success",
+			Help: "Displays whether or not a connection attempt won the race",
+		}, []string{"attempt", "ip"}),
+	}
+	if h.attemptDelay == 0 {
+		h.attemptDelay = defaultHappyEyeballsAttemptDelay
+	}
+	registry.MustRegister(probeDNSLookupTimeSeconds, h.probeIPProtocolGauge, h.probeIPAddrHash,
+		h.probeAttemptDelayGaugeVec, h.probeAttemptConnectTimeGaugeVec, h.probeAttemptSuccessGaugeVec)
+
+	level.Info(logger).Log("msg", "Resolving all target addresses for Happy Eyeballs")
+	resolveStart := time.Now()
+	addrs, err := lookupIPAddr(ctx, rc, host)
+	lookupTime := time.Since(resolveStart).Seconds()
+	probeDNSLookupTimeSeconds.Add(lookupTime)
+	if err != nil {
+		level.Error(logger).Log("msg", "Resolution failed", "err", err)
+		return nil, lookupTime, err
+	}
+	h.ips = sortHappyEyeballs(addrs, IPProtocol)
+	if len(h.ips) == 0 {
+		return nil, lookupTime, errors.New("no addresses to connect to")
+	}
+	level.Info(logger).Log("msg", "Resolved target addresses", "ips", len(h.ips))
+	return h, lookupTime, nil
+}
+
+// dial connects to port of the host with dial, and exports the attempts.
+// HTTP tracing sees a ConnectStart and a ConnectDone for every attempt made
+// with a net.Dialer, losing ones included, just as with its own dual stack
+// dialing.
+func (h *happyEyeballs) dial(ctx context.Context, dial dialContextFunc, port string) (net.Conn, error) {
+	conn, winner, attempts, err := dialHappyEyeballs(ctx, dial, h.ips, port, h.attemptDelay)
+	for i, attempt := range attempts {
+		labels := []string{strconv.Itoa(i), attempt.ip.String()}
+		h.probeAttemptDelayGaugeVec.WithLabelValues(labels...).Set(attempt.delay.Seconds())
+		h.probeAttemptConnectTimeGaugeVec.WithLabelValues(labels...).Set(attempt.connectTime.Seconds())
+		if i == winner {
+			h.probeAttemptSuccessGaugeVec.WithLabelValues(labels...).Set(1)
+			h.probeIPAddrHash.Set(ipHash(attempt.ip))
+			if attempt.ip.To4() != nil {
+				h.probeIPProtocolGauge.Set(4)
+			} else {
+				h.probeIPProtocolGauge.Set(6)
+			}
+			level.Info(h.logger).Log("msg", "Connection attempt won", "attempt", i, "ip", attempt.ip, "delay", attempt.delay, "connect_time", attempt.connectTime)
+		} else {
+			h.probeAttemptSuccessGaugeVec.WithLabelValues(labels...).Set(0)
+			level.Info(h.logger).Log("msg", "Connection attempt lost", "attempt", i, "ip", attempt.ip, "delay", attempt.delay, "connect_time", attempt.connectTime, "err", attempt.err)
+		}
+	}
+	return conn, err
+}
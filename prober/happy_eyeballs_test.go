@@ -0,0 +1,247 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestSortHappyEyeballs(t *testing.T) {
+	var addrs []net.IPAddr
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2"} {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	tests := map[string][]string{
+		"":    {"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		"ip6": {"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		"ip4": {"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"},
+	}
+	for ipProtocol, expected := range tests {
+		ips := sortHappyEyeballs(addrs, ipProtocol)
+		if len(ips) != len(expected) {
+			t.Fatalf("Expected %d addresses preferring %q, got %d", len(expected), ipProtocol, len(ips))
+		}
+		for i, ip := range ips {
+			if ip.String() != expected[i] {
+				t.Errorf("Expected address %d preferring %q to be %s, got %s", i, ipProtocol, expected[i], ip)
+			}
+		}
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	attemptDelay := 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// Dials of IPv6 addresses.
+		dial6       func(ctx context.Context) (net.Conn, error)
+		minDelay    time.Duration
+		maxDelay    time.Duration
+		expectedErr bool
+	}{
+		{
+			name: "IPv6 blackholed",
+			dial6: func(ctx context.Context) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			minDelay:    attemptDelay,
+			maxDelay:    time.Second,
+			expectedErr: true,
+		},
+		{
+			name: "IPv6 refused",
+			dial6: func(ctx context.Context) (net.Conn, error) {
+				return nil, errors.New("connection refused")
+			},
+			minDelay:    0,
+			maxDelay:    attemptDelay,
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+			if network == "tcp6" {
+				return test.dial6(ctx)
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		conn, winner, attempts, err := dialHappyEyeballs(context.Background(), dial, ips, "80", attemptDelay)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		conn.Close()
+		if winner != 1 {
+			t.Fatalf("%s: expected the IPv4 attempt to win, got attempt %d", test.name, winner)
+		}
+		if len(attempts) != 2 {
+			t.Fatalf("%s: expected 2 attempts, got %d", test.name, len(attempts))
+		}
+		if attempts[1].delay < test.minDelay || attempts[1].delay >= test.maxDelay {
+			t.Errorf("%s: expected the IPv4 attempt after %s to %s, got %s", test.name, test.minDelay, test.maxDelay, attempts[1].delay)
+		}
+		if (attempts[0].err != nil) != test.expectedErr {
+			t.Errorf("%s: unexpected result of the IPv6 attempt: %v", test.name, attempts[0].err)
+		}
+	}
+}
+
+func TestDialHappyEyeballsAllFailed(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, fmt.Errorf("%s refused", address)
+	}
+	_, winner, attempts, err := dialHappyEyeballs(context.Background(), dial, ips, "80", time.Second)
+	if err == nil || winner != -1 {
+		t.Fatalf("Expected an error, got winner %d", winner)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(attempts))
+	}
+}
+
+func TestTCPHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	module := config.Module{
+		Resolver: config.Resolver{Overrides: map[string][]string{"backend.example": {"127.0.0.1"}}},
+		TCP:      config.TCPProbe{HappyEyeballs: true},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	if !ProbeTCP(testCTX, net.JoinHostPort("backend.example", port), module, registry, log.NewNopLogger()) {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRegistryResults(map[string]float64{
+		"probe_ip_protocol":                    4,
+		"probe_happy_eyeballs_attempt_success": 1,
+	}, mfs, t)
+	checkRegistryLabels(map[string]map[string]string{
+		"probe_happy_eyeballs_attempt_connect_seconds": {"attempt": "0", "ip": "127.0.0.1"},
+	}, mfs, t)
+}
+
+func TestHTTPHappyEyeballs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "host %s", r.Host)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "http://" + net.JoinHostPort("backend.example", u.Port()) + "/"
+
+	module := config.Module{
+		Timeout:  time.Second,
+		Resolver: config.Resolver{Overrides: map[string][]string{"backend.example": {"127.0.0.1"}}},
+		HTTP: config.HTTPProbe{
+			HappyEyeballs:              true,
+			FailIfBodyNotMatchesRegexp: []string{"^host backend.example:" + u.Port() + "$"},
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	if !ProbeHTTP(testCTX, target, module, registry, log.NewNopLogger()) {
+		t.Fatalf("HTTP module failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRegistryResults(map[string]float64{
+		"probe_ip_protocol":                    4,
+		"probe_happy_eyeballs_attempt_success": 1,
+	}, mfs, t)
+}
+
+func TestHappyEyeballsTrace(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// Nothing listens on 127.0.0.2, so the first attempt is refused.
+	rc := config.Resolver{Overrides: map[string][]string{"backend.example": {"127.0.0.2", "127.0.0.1"}}}
+	he, _, err := newHappyEyeballs(context.Background(), rc, "backend.example", "ip4", 10*time.Millisecond, prometheus.NewRegistry(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var started []string
+	done := map[string]error{}
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			started = append(started, addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			done[addr] = err
+		},
+	})
+	conn, err := he.dial(ctx, (&net.Dialer{}).DialContext, port)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conn.Close()
+	refused, won := net.JoinHostPort("127.0.0.2", port), net.JoinHostPort("127.0.0.1", port)
+	if strings.Join(started, ",") != refused+","+won {
+		t.Errorf("Expected connections to start to %s and %s, got %v", refused, won, started)
+	}
+	if len(done) != 2 || done[refused] == nil || done[won] != nil {
+		t.Errorf("Expected the connection to %s to fail and the one to %s to succeed, got %v", refused, won, done)
+	}
+}
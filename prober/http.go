@@ -14,7 +14,9 @@
 package prober
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -33,8 +35,10 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/mwitkow/go-conntrack"
 	"github.com/prometheus/client_golang/prometheus"
 	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/publicsuffix"
 
 	"github.com/prometheus/blackbox_exporter/config"
@@ -142,6 +146,55 @@ type roundTripTrace struct {
 	gotConn       time.Time
 	responseStart time.Time
 	end           time.Time
+	reused        bool
+}
+
+// newRoundTripper is like pconfig.NewRoundTripperFromConfig, except that
+// connections are made with dialContext if it is set. The vendored
+// prometheus/common has no option to replace the dialer, so the transport
+// is built the same way here, with dials still tracked by conntrack. The
+// round tripper only lives for a single probe, so the CA file is read
+// afresh by every probe just like pconfig's reloading round tripper does.
+func newRoundTripper(cfg pconfig.HTTPClientConfig, dialContext dialContextFunc) (http.RoundTripper, error) {
+	if dialContext == nil {
+		return pconfig.NewRoundTripperFromConfig(cfg, "http_probe", true)
+	}
+	tlsConfig, err := pconfig.NewTLSConfig(&cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyURL(cfg.ProxyURL.URL),
+		DisableKeepAlives:     true,
+		TLSClientConfig:       tlsConfig,
+		DisableCompression:    true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DialContext: conntrack.NewDialContextFunc(
+			conntrack.DialWithTracing(),
+			conntrack.DialWithName("http_probe"),
+			conntrack.DialWithDialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialContext(ctx, network, address)
+			}),
+		),
+	}
+	if err := http2.ConfigureTransport(rt.(*http.Transport)); err != nil {
+		return nil, err
+	}
+	return authRoundTripper(cfg, rt), nil
+}
+
+// authRoundTripper wraps rt to send the credentials of cfg.
+func authRoundTripper(cfg pconfig.HTTPClientConfig, rt http.RoundTripper) http.RoundTripper {
+	if len(cfg.BearerToken) > 0 {
+		rt = pconfig.NewBearerAuthRoundTripper(cfg.BearerToken, rt)
+	} else if len(cfg.BearerTokenFile) > 0 {
+		rt = pconfig.NewBearerAuthFileRoundTripper(cfg.BearerTokenFile, rt)
+	}
+	if cfg.BasicAuth != nil {
+		rt = pconfig.NewBasicAuthRoundTripper(cfg.BasicAuth.Username, cfg.BasicAuth.Password, cfg.BasicAuth.PasswordFile, rt)
+	}
+	return rt
 }
 
 // transport is a custom transport keeping traces for each HTTP roundtrip.
@@ -190,6 +243,19 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return t.Transport.RoundTrip(req)
 }
 
+// CloseIdleConnections closes the idle connections of the embedded
+// RoundTrippers.
+func (t *transport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	for _, rt := range []http.RoundTripper{t.Transport, t.NoServerNameTransport} {
+		if ci, ok := rt.(closeIdler); ok {
+			ci.CloseIdleConnections()
+		}
+	}
+}
+
 func (t *transport) DNSStart(_ httptrace.DNSStartInfo) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -215,10 +281,17 @@ func (t *transport) ConnectDone(net, addr string, err error) {
 	defer t.mu.Unlock()
 	t.current.connectDone = time.Now()
 }
-func (t *transport) GotConn(_ httptrace.GotConnInfo) {
+func (t *transport) GotConn(info httptrace.GotConnInfo) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.current.gotConn = time.Now()
+	t.current.reused = info.Reused
+	// No connection was made for a reused connection.
+	if info.Reused && t.current.dnsDone.IsZero() {
+		t.current.start = t.current.gotConn
+		t.current.dnsDone = t.current.gotConn
+		t.current.connectDone = t.current.gotConn
+	}
 }
 func (t *transport) GotFirstResponseByte() {
 	t.mu.Lock()
@@ -309,6 +382,27 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 			Name: "probe_http_last_modified_timestamp_seconds",
 			Help: "Returns the Last-Modified HTTP response header in unixtime",
 		})
+
+		probeHTTPConnectionReused = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_connection_reused",
+			Help: "Indicates if the connection of the final request was reused",
+		})
+
+		probeHTTPALPNProtocol = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "probe_http_alpn_protocol_info",
+				Help: "Contains the application protocol negotiated via TLS ALPN",
+			},
+			[]string{"protocol"},
+		)
+
+		probeHTTP2Settings = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "probe_http2_settings",
+				Help: "Values of the HTTP/2 SETTINGS frame received from the server",
+			},
+			[]string{"setting"},
+		)
 	)
 
 	for _, lv := range []string{"resolve", "connect", "tls", "processing", "transfer"} {
@@ -323,9 +417,24 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 	registry.MustRegister(statusCodeGauge)
 	registry.MustRegister(probeHTTPVersionGauge)
 	registry.MustRegister(probeFailedDueToRegex)
+	registry.MustRegister(probeHTTPConnectionReused)
 
 	httpConfig := module.HTTP
 
+	// Requests to a Unix domain socket are made to localhost, with the path
+	// following the socket.
+	unixSocket, requestPath, isUnix := splitUnixTarget(target)
+	if isUnix {
+		if err := checkUnixProxyProtocol(module.ProxyProtocol); err != nil {
+			level.Error(logger).Log("msg", "Error sending PROXY protocol header", "err", err)
+			return false
+		}
+		if requestPath == "" {
+			requestPath = "/"
+		}
+		target = "http://localhost" + requestPath
+	}
+
 	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
 		target = "http://" + target
 	}
@@ -339,12 +448,30 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 	targetHost := targetURL.Hostname()
 	targetPort := targetURL.Port()
 
-	ip, lookupTime, err := chooseProtocol(ctx, module.HTTP.IPProtocol, module.HTTP.IPProtocolFallback, targetHost, registry, logger)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error resolving address", "err", err)
-		return false
+	var ip *net.IPAddr
+	var he *happyEyeballs
+	switch {
+	case isUnix:
+	case module.ProxyDialer.URL.URL != nil:
+		// The proxy resolves the target, whose name might only be known
+		// behind it.
+	case httpConfig.HappyEyeballs:
+		var lookupTime float64
+		he, lookupTime, err = newHappyEyeballs(ctx, module.Resolver, targetHost, module.HTTP.IPProtocol, httpConfig.HappyEyeballsAttemptDelay, registry, logger)
+		durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error resolving address", "err", err)
+			return false
+		}
+	default:
+		var lookupTime float64
+		ip, lookupTime, err = chooseProtocol(ctx, module.Resolver, module.HTTP.IPProtocol, module.HTTP.IPProtocolFallback, targetHost, registry, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error resolving address", "err", err)
+			return false
+		}
+		durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
 	}
-	durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
 
 	httpClientConfig := module.HTTP.HTTPClientConfig
 	if len(httpClientConfig.TLSConfig.ServerName) == 0 {
@@ -352,14 +479,88 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		// the hostname of the target.
 		httpClientConfig.TLSConfig.ServerName = targetHost
 	}
-	client, err := pconfig.NewClientFromConfig(httpClientConfig, "http_probe", true)
+	dialer := &net.Dialer{}
+	if len(httpConfig.SourceIPAddress) > 0 {
+		srcIP := net.ParseIP(httpConfig.SourceIPAddress)
+		if srcIP == nil {
+			level.Error(logger).Log("msg", "Error parsing source ip address", "srcIP", httpConfig.SourceIPAddress)
+			return false
+		}
+		level.Info(logger).Log("msg", "Using local address", "srcIP", srcIP)
+		dialer.LocalAddr = &net.TCPAddr{IP: srcIP}
+	}
+	if len(httpConfig.SourceInterface) > 0 {
+		level.Info(logger).Log("msg", "Using source interface", "interface", httpConfig.SourceInterface)
+		dialer.Control = bindToDeviceControl(httpConfig.SourceInterface)
+	}
+
+	var dialContext dialContextFunc
+	if module.ProxyDialer.URL.URL != nil || module.ProxyProtocol.Version != 0 || dialer.LocalAddr != nil || dialer.Control != nil {
+		dial := moduleDialContext(module, dialer)
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeProxyProtocolHeader(conn, module.ProxyProtocol); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("error sending PROXY protocol header: %s", err)
+			}
+			return conn, nil
+		}
+	}
+	if isUnix {
+		// Connections to the target go to the socket, while redirects to
+		// other hosts are followed as usual.
+		dial := dialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == "localhost:80" {
+				return (&net.Dialer{}).DialContext(ctx, "unix", unixSocket)
+			}
+			return dial(ctx, network, address)
+		}
+	}
+	if he != nil {
+		// Connections to the target race its addresses, while redirects to
+		// other hosts are followed as usual.
+		dial := dialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		heAddress := targetURL.Host
+		if targetPort == "" {
+			heAddress = net.JoinHostPort(targetHost, "80")
+			if targetURL.Scheme == "https" {
+				heAddress = net.JoinHostPort(targetHost, "443")
+			}
+		}
+		_, hePort, _ := net.SplitHostPort(heAddress)
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == heAddress {
+				return he.dial(ctx, dial, hePort)
+			}
+			return dial(ctx, network, address)
+		}
+	}
+	http2Settings := &http2SettingsRecorder{}
+	newRT := func(cfg pconfig.HTTPClientConfig) (http.RoundTripper, error) {
+		if httpConfig.HTTP2Mode != "" {
+			return newHTTP2RoundTripper(cfg, httpConfig.HTTP2Mode, dialContext, http2Settings)
+		}
+		return newRoundTripper(cfg, dialContext)
+	}
+	rt, err := newRT(httpClientConfig)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error generating HTTP client", "err", err)
 		return false
 	}
+	client := &http.Client{Transport: rt}
 
 	httpClientConfig.TLSConfig.ServerName = ""
-	noServerName, err := pconfig.NewRoundTripperFromConfig(httpClientConfig, "http_probe", true)
+	noServerName, err := newRT(httpClientConfig)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error generating HTTP client without ServerName", "err", err)
 		return false
@@ -376,6 +577,8 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 	// and does not set TLS ServerNames on redirect if needed.
 	tt := newTransport(client.Transport, noServerName, logger)
 	client.Transport = tt
+	// Connections must not outlive the probe.
+	defer client.CloseIdleConnections()
 
 	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
 		level.Info(logger).Log("msg", "Received redirect", "location", r.Response.Header.Get("Location"))
@@ -391,16 +594,18 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		httpConfig.Method = "GET"
 	}
 
-	// Replace the host field in the URL with the IP we resolved.
+	// Replace the host field in the URL with the IP we resolved, if any.
 	origHost := targetURL.Host
-	if targetPort == "" {
-		if strings.Contains(ip.String(), ":") {
-			targetURL.Host = "[" + ip.String() + "]"
+	if ip != nil {
+		if targetPort == "" {
+			if strings.Contains(ip.String(), ":") {
+				targetURL.Host = "[" + ip.String() + "]"
+			} else {
+				targetURL.Host = ip.String()
+			}
 		} else {
-			targetURL.Host = ip.String()
+			targetURL.Host = net.JoinHostPort(ip.String(), targetPort)
 		}
-	} else {
-		targetURL.Host = net.JoinHostPort(ip.String(), targetPort)
 	}
 
 	var body io.Reader
@@ -419,6 +624,12 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		return
 	}
 
+	eventStream := httpConfig.EventStream.Events > 0 || httpConfig.EventStream.Expect != ""
+	if eventStream {
+		request.Header.Set("Accept", "text/event-stream")
+		request.Header.Set("Cache-Control", "no-cache")
+	}
+
 	for key, value := range httpConfig.Headers {
 		if strings.Title(key) == "Host" {
 			request.Host = value
@@ -434,13 +645,20 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		ConnectDone:          tt.ConnectDone,
 		GotConn:              tt.GotConn,
 		GotFirstResponseByte: tt.GotFirstResponseByte,
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				recordFailure(ctx, FailureTLSHandshake)
+			}
+		},
 	}
 	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
 
+	requestStart := time.Now()
 	resp, err := client.Do(request)
 	// Err won't be nil if redirects were turned off. See https://github.com/golang/go/issues/3795
 	if err != nil && resp == nil {
 		level.Error(logger).Log("msg", "Error for HTTP request", "err", err)
+		recordError(ctx, err)
 	} else {
 		requestErrored := (err != nil)
 
@@ -455,11 +673,13 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 			if !success {
 				level.Info(logger).Log("msg", "Invalid HTTP response status code", "status_code", resp.StatusCode,
 					"valid_status_codes", fmt.Sprintf("%v", httpConfig.ValidStatusCodes))
+				recordFailure(ctx, FailureStatus)
 			}
 		} else if 200 <= resp.StatusCode && resp.StatusCode < 300 {
 			success = true
 		} else {
 			level.Info(logger).Log("msg", "Invalid HTTP response status code, wanted 2xx", "status_code", resp.StatusCode)
+			recordFailure(ctx, FailureStatus)
 		}
 
 		if success && (len(httpConfig.FailIfHeaderMatchesRegexp) > 0 || len(httpConfig.FailIfHeaderNotMatchesRegexp) > 0) {
@@ -473,8 +693,31 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 
 		byteCounter := &byteCounter{ReadCloser: resp.Body}
 
+		var bodyReader io.Reader = byteCounter
+		if success && len(httpConfig.Metrics) > 0 {
+			// The body is needed for both the regexps and the metrics.
+			bodyBytes, err := ioutil.ReadAll(byteCounter)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error reading HTTP body", "err", err)
+				success = false
+			}
+			extractor := newMetricExtractor(logger)
+			defer extractor.register(registry)
+			for _, m := range httpConfig.Metrics {
+				if err := extractor.extract(m, bodyBytes); err != nil {
+					level.Error(logger).Log("msg", "Could not compile regular expression", "regexp", m.Regexp, "err", err)
+					success = false
+				}
+			}
+			bodyReader = bytes.NewReader(bodyBytes)
+		}
+
+		if success && eventStream {
+			success = probeEventStream(resp, byteCounter, httpConfig.EventStream, requestStart, probeFailedDueToRegex, registry, logger)
+		}
+
 		if success && (len(httpConfig.FailIfBodyMatchesRegexp) > 0 || len(httpConfig.FailIfBodyNotMatchesRegexp) > 0) {
-			success = matchRegularExpressions(byteCounter, httpConfig, logger)
+			success = matchRegularExpressions(bodyReader, httpConfig, logger)
 			if success {
 				probeFailedDueToRegex.Set(0)
 			} else {
@@ -483,10 +726,13 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		}
 
 		if resp != nil && !requestErrored {
-			_, err = io.Copy(ioutil.Discard, byteCounter)
-			if err != nil {
-				level.Info(logger).Log("msg", "Failed to read HTTP response body", "err", err)
-				success = false
+			// An event stream does not end, stop reading once done.
+			if !eventStream {
+				_, err = io.Copy(ioutil.Discard, byteCounter)
+				if err != nil {
+					level.Info(logger).Log("msg", "Failed to read HTTP response body", "err", err)
+					success = false
+				}
 			}
 
 			respBodyBytes = byteCounter.n
@@ -583,6 +829,8 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		probeTLSVersion.WithLabelValues(getTLSVersion(resp.TLS)).Set(1)
 		probeSSLLastChainExpiryTimestampSeconds.Set(float64(getLastChainExpiry(resp.TLS).Unix()))
 		probeSSLLastInformation.WithLabelValues(getFingerprint(resp.TLS)).Set(1)
+		registry.MustRegister(probeHTTPALPNProtocol)
+		probeHTTPALPNProtocol.WithLabelValues(resp.TLS.NegotiatedProtocol).Set(1)
 		if httpConfig.FailIfSSL {
 			level.Error(logger).Log("msg", "Final request was over SSL")
 			success = false
@@ -592,6 +840,16 @@ func ProbeHTTP(ctx context.Context, target string, module config.Module, registr
 		success = false
 	}
 
+	if tt.current != nil && tt.current.reused {
+		probeHTTPConnectionReused.Set(1)
+	}
+	if settings := http2Settings.received(); len(settings) > 0 {
+		registry.MustRegister(probeHTTP2Settings)
+		for _, setting := range settings {
+			probeHTTP2Settings.WithLabelValues(setting.ID.String()).Set(float64(setting.Val))
+		}
+	}
+
 	statusCodeGauge.Set(float64(resp.StatusCode))
 	contentLengthGauge.Set(float64(resp.ContentLength))
 	bodyUncompressedLengthGauge.Set(float64(respBodyBytes))
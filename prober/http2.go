@@ -0,0 +1,422 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+
+	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2SettingsRecorder keeps the first SETTINGS frame sent by the server.
+type http2SettingsRecorder struct {
+	mu       sync.Mutex
+	buf      []byte
+	done     bool
+	settings []http2.Setting
+}
+
+// record parses the frames read from the connection until the SETTINGS
+// frame, which is the first frame a server sends.
+func (r *http2SettingsRecorder) record(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.buf = append(r.buf, p...)
+	for len(r.buf) >= 9 {
+		length := int(r.buf[0])<<16 | int(r.buf[1])<<8 | int(r.buf[2])
+		if len(r.buf) < 9+length {
+			return
+		}
+		if http2.FrameType(r.buf[3]) == http2.FrameSettings && r.buf[4]&byte(http2.FlagSettingsAck) == 0 {
+			for payload := r.buf[9 : 9+length]; len(payload) >= 6; payload = payload[6:] {
+				r.settings = append(r.settings, http2.Setting{
+					ID:  http2.SettingID(binary.BigEndian.Uint16(payload)),
+					Val: binary.BigEndian.Uint32(payload[2:]),
+				})
+			}
+			r.done, r.buf = true, nil
+			return
+		}
+		r.buf = r.buf[9+length:]
+	}
+}
+
+func (r *http2SettingsRecorder) set(f *http2.SettingsFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	f.ForeachSetting(func(s http2.Setting) error {
+		r.settings = append(r.settings, s)
+		return nil
+	})
+	r.done = true
+}
+
+func (r *http2SettingsRecorder) received() []http2.Setting {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.settings
+}
+
+// settingsRecorderConn passes the data read to a http2SettingsRecorder.
+type settingsRecorderConn struct {
+	net.Conn
+	recorder *http2SettingsRecorder
+}
+
+func (c *settingsRecorderConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.recorder.record(p[:n])
+	return n, err
+}
+
+// tlsSettingsRecorderConn keeps the TLS connection state available to the
+// HTTP/2 transport.
+type tlsSettingsRecorderConn struct {
+	settingsRecorderConn
+	tlsConn *tls.Conn
+}
+
+func (c *tlsSettingsRecorderConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+// newHTTP2RoundTripper returns a RoundTripper using HTTP/2 as per mode: over
+// TLS, with prior knowledge or after an upgrade from HTTP/1.1.
+func newHTTP2RoundTripper(cfg pconfig.HTTPClientConfig, mode string, dialContext dialContextFunc, recorder *http2SettingsRecorder) (http.RoundTripper, error) {
+	if dialContext == nil {
+		dialContext = (&net.Dialer{}).DialContext
+	}
+	if mode == "upgrade" {
+		return authRoundTripper(cfg, &h2cUpgradeRoundTripper{dial: dialContext, recorder: recorder}), nil
+	}
+	tlsConfig, err := pconfig.NewTLSConfig(&cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	rt := &http2RoundTripper{mode: mode, dial: dialContext, recorder: recorder}
+	rt.transport = &http2.Transport{
+		AllowHTTP:          mode == "prior_knowledge",
+		DialTLS:            rt.dialConn,
+		TLSClientConfig:    tlsConfig,
+		DisableCompression: true,
+	}
+	return authRoundTripper(cfg, rt), nil
+}
+
+// http2RoundTripper forces HTTP/2 over TLS, or cleartext HTTP/2 with prior
+// knowledge.
+type http2RoundTripper struct {
+	mode      string
+	dial      dialContextFunc
+	recorder  *http2SettingsRecorder
+	transport *http2.Transport
+
+	// The context of the current request, used to dial.
+	ctx context.Context
+}
+
+func (t *http2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.mode == "tls" && req.URL.Scheme != "https":
+		return nil, errors.New("HTTP/2 over TLS requires an https URL")
+	case t.mode == "prior_knowledge" && req.URL.Scheme != "http":
+		return nil, errors.New("HTTP/2 with prior knowledge requires an http URL")
+	}
+	t.ctx = req.Context()
+	return t.transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the connections kept by the HTTP/2 transport,
+// along with their reader goroutines.
+func (t *http2RoundTripper) CloseIdleConnections() {
+	t.transport.CloseIdleConnections()
+}
+
+func (t *http2RoundTripper) dialConn(network, address string, cfg *tls.Config) (net.Conn, error) {
+	trace := httptrace.ContextClientTrace(t.ctx)
+	conn, err := dialWithTrace(t.ctx, trace, t.dial, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if t.mode != "tls" {
+		return &settingsRecorderConn{Conn: conn, recorder: t.recorder}, nil
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = tlsConn.Handshake()
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("server did not negotiate %q via ALPN, got %q", http2.NextProtoTLS, p)
+	}
+	return &tlsSettingsRecorderConn{
+		settingsRecorderConn: settingsRecorderConn{Conn: tlsConn, recorder: t.recorder},
+		tlsConn:              tlsConn,
+	}, nil
+}
+
+// dialWithTrace dials, reporting the connection to the trace as the
+// transport of net/http does.
+func dialWithTrace(ctx context.Context, trace *httptrace.ClientTrace, dial dialContextFunc, network, address string) (net.Conn, error) {
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart(network, address)
+	}
+	conn, err := dial(ctx, network, address)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone(network, address, err)
+	}
+	return conn, err
+}
+
+// h2cUpgradeRoundTripper sends requests over HTTP/1.1 asking for an upgrade
+// to cleartext HTTP/2, and reads the response over HTTP/2 if the server
+// accepts it.
+type h2cUpgradeRoundTripper struct {
+	dial     dialContextFunc
+	recorder *http2SettingsRecorder
+}
+
+// connBody closes the connection along with the body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+func (t *h2cUpgradeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return nil, errors.New("h2c upgrade requires an http URL")
+	}
+	ctx := req.Context()
+	trace := httptrace.ContextClientTrace(ctx)
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		address = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	conn, err := dialWithTrace(ctx, trace, t.dial, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	settings := []http2.Setting{{ID: http2.SettingEnablePush, Val: 0}}
+	var payload []byte
+	for _, s := range settings {
+		b := make([]byte, 6)
+		binary.BigEndian.PutUint16(b, uint16(s.ID))
+		binary.BigEndian.PutUint32(b[2:], s.Val)
+		payload = append(payload, b...)
+	}
+	upgradeReq := req.Clone(ctx)
+	upgradeReq.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	upgradeReq.Header.Set("Upgrade", "h2c")
+	upgradeReq.Header.Set("HTTP2-Settings", base64.RawURLEncoding.EncodeToString(payload))
+	if err := upgradeReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if trace != nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+		return resp, nil
+	}
+	resp, err = t.readUpgradedResponse(conn, br, req, settings)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readUpgradedResponse reads the response to the upgrade request, which the
+// server sends on stream 1. The body is streamed from the DATA frames as it
+// is read, and closing it closes conn.
+func (t *h2cUpgradeRoundTripper) readUpgradedResponse(conn net.Conn, br *bufio.Reader, req *http.Request, settings []http2.Setting) (*http.Response, error) {
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, err
+	}
+	framer := http2.NewFramer(conn, br)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(settings...); err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        http.Header{},
+		Request:       req,
+		ContentLength: -1,
+	}
+	ended := false
+	for resp.StatusCode == 0 {
+		frame, err := t.readStreamFrame(framer)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := frame.(*http2.MetaHeadersFrame)
+		if !ok {
+			return nil, errors.New("server sent DATA before the response headers")
+		}
+		status := f.PseudoValue("status")
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", status)
+		}
+		if code/100 == 1 {
+			continue
+		}
+		resp.StatusCode = code
+		resp.Status = status + " " + http.StatusText(code)
+		for _, hf := range f.RegularFields() {
+			resp.Header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+		}
+		ended = f.StreamEnded()
+	}
+	if cl, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = cl
+	}
+
+	pr, pw := io.Pipe()
+	resp.Body = &connBody{ReadCloser: pr, conn: conn}
+	if ended {
+		pw.Close()
+		return resp, nil
+	}
+	go func() {
+		pw.CloseWithError(t.streamBody(framer, pw))
+	}()
+	return resp, nil
+}
+
+// streamBody writes the DATA frames of stream 1 to w until the stream ends.
+// Flow control credit is only returned once w accepted the data, so a body
+// that is not read does not pile up in memory.
+func (t *h2cUpgradeRoundTripper) streamBody(framer *http2.Framer, w io.Writer) error {
+	for {
+		frame, err := t.readStreamFrame(framer)
+		if err != nil {
+			return err
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			// Trailers end the stream.
+			if f.StreamEnded() {
+				return nil
+			}
+		case *http2.DataFrame:
+			if _, err := w.Write(f.Data()); err != nil {
+				return err
+			}
+			if f.Length > 0 {
+				if err := framer.WriteWindowUpdate(0, f.Length); err != nil {
+					return err
+				}
+				if !f.StreamEnded() {
+					if err := framer.WriteWindowUpdate(1, f.Length); err != nil {
+						return err
+					}
+				}
+			}
+			if f.StreamEnded() {
+				return nil
+			}
+		}
+	}
+}
+
+// readStreamFrame reads frames until one with headers or data of stream 1,
+// answering SETTINGS and PING frames on the way.
+func (t *h2cUpgradeRoundTripper) readStreamFrame(framer *http2.Framer) (http2.Frame, error) {
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			t.recorder.set(f)
+			if err := framer.WriteSettingsAck(); err != nil {
+				return nil, err
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				if err := framer.WritePing(true, f.Data); err != nil {
+					return nil, err
+				}
+			}
+		case *http2.MetaHeadersFrame, *http2.DataFrame:
+			if frame.Header().StreamID == 1 {
+				return frame, nil
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == 1 {
+				return nil, fmt.Errorf("stream reset by server with error code %v", f.ErrCode)
+			}
+		case *http2.GoAwayFrame:
+			return nil, fmt.Errorf("server sent GOAWAY with error code %v", f.ErrCode)
+		}
+	}
+}
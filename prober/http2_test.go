@@ -0,0 +1,299 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// serveH2CUpgrade answers a request asking for an h2c upgrade over HTTP/2,
+// and other requests over HTTP/1.1.
+func serveH2CUpgrade(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if req.Header.Get("Upgrade") != "h2c" || req.Header.Get("HTTP2-Settings") == "" {
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nplain")
+		return
+	}
+	fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(br, preface); err != nil || string(preface) != http2.ClientPreface {
+		t.Errorf("Invalid client preface %q: %v", preface, err)
+		return
+	}
+	framer := http2.NewFramer(conn, br)
+	framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 10})
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Errorf("Error reading frame: %s", err)
+			return
+		}
+		if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+			framer.WriteSettingsAck()
+			break
+		}
+	}
+	var headers bytes.Buffer
+	encoder := hpack.NewEncoder(&headers)
+	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	encoder.WriteField(hpack.HeaderField{Name: "content-type", Value: "text/plain"})
+	framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: headers.Bytes(), EndHeaders: true})
+	framer.WriteData(1, true, []byte("upgraded"))
+	io.Copy(ioutil.Discard, br)
+}
+
+func TestHTTP2Modes(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "proto %s", r.Proto)
+	})
+
+	priorKnowledge, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer priorKnowledge.Close()
+	go func() {
+		for {
+			conn, err := priorKnowledge.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	upgrade, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer upgrade.Close()
+	go func() {
+		for {
+			conn, err := upgrade.Accept()
+			if err != nil {
+				return
+			}
+			go serveH2CUpgrade(t, conn)
+		}
+	}()
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	tests := []struct {
+		target            string
+		mode              string
+		validHTTPVersions []string
+		bodyRegexp        string
+		success           bool
+		alpn              string
+		settings          bool
+	}{
+		{target: "http://" + priorKnowledge.Addr().String(), mode: "prior_knowledge", bodyRegexp: "proto HTTP/2.0",
+			validHTTPVersions: []string{"HTTP/2.0"}, success: true, settings: true},
+		{target: h2.URL, mode: "prior_knowledge", success: false},
+		{target: h2.URL, mode: "tls", bodyRegexp: "proto HTTP/2.0", validHTTPVersions: []string{"HTTP/2.0"},
+			success: true, alpn: "h2", settings: true},
+		{target: h1.URL, mode: "tls", success: false},
+		{target: h1.URL, success: true, alpn: "http/1.1"},
+		{target: "http://" + upgrade.Addr().String(), mode: "upgrade", bodyRegexp: "upgraded",
+			validHTTPVersions: []string{"HTTP/2.0"}, success: true, settings: true},
+		{target: plain.URL, mode: "upgrade", validHTTPVersions: []string{"HTTP/2.0"}, success: false},
+		{target: plain.URL, mode: "upgrade", validHTTPVersions: []string{"HTTP/1.1"}, success: true},
+	}
+	for i, test := range tests {
+		module := config.Module{
+			Timeout: time.Second,
+			HTTP: config.HTTPProbe{
+				IPProtocolFallback: true,
+				HTTP2Mode:          test.mode,
+				ValidHTTPVersions:  test.validHTTPVersions,
+				HTTPClientConfig: pconfig.HTTPClientConfig{
+					TLSConfig: pconfig.TLSConfig{InsecureSkipVerify: true},
+				},
+			},
+		}
+		if test.bodyRegexp != "" {
+			module.HTTP.FailIfBodyNotMatchesRegexp = []string{test.bodyRegexp}
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), time.Second)
+		registry := prometheus.NewRegistry()
+		success := ProbeHTTP(testCTX, test.target, module, registry, log.NewNopLogger())
+		cancel()
+		if success != test.success {
+			t.Fatalf("Test %d: expected success %v, got %v", i, test.success, success)
+		}
+		if !success {
+			continue
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		alpn, settings := "", false
+		for _, mf := range mfs {
+			switch mf.GetName() {
+			case "probe_http_alpn_protocol_info":
+				alpn = mf.GetMetric()[0].GetLabel()[0].GetValue()
+			case "probe_http2_settings":
+				settings = len(mf.GetMetric()) > 0
+			}
+		}
+		if alpn != test.alpn {
+			t.Errorf("Test %d: expected ALPN protocol %q, got %q", i, test.alpn, alpn)
+		}
+		if settings != test.settings {
+			t.Errorf("Test %d: expected settings %v, got %v", i, test.settings, settings)
+		}
+	}
+}
+
+func TestHTTP2ModeClosesConnections(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	module := config.Module{
+		Timeout: time.Second,
+		HTTP: config.HTTPProbe{
+			IPProtocolFallback: true,
+			HTTP2Mode:          "tls",
+			HTTPClientConfig: pconfig.HTTPClientConfig{
+				TLSConfig: pconfig.TLSConfig{InsecureSkipVerify: true},
+			},
+		},
+	}
+	probe := func() {
+		testCTX, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if !ProbeHTTP(testCTX, ts.URL, module, prometheus.NewRegistry(), log.NewNopLogger()) {
+			t.Fatalf("HTTP module failed, expected success.")
+		}
+	}
+	// Let the server start its goroutines.
+	probe()
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		probe()
+	}
+	// Connections are closed asynchronously.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Fatalf("Goroutines went from %d to %d after 20 probes", before, after)
+	}
+}
+
+func TestH2CUpgradeStreamsBody(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	release := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(br, preface); err != nil {
+			return
+		}
+		framer := http2.NewFramer(conn, br)
+		framer.WriteSettings()
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+				framer.WriteSettingsAck()
+				break
+			}
+		}
+		var headers bytes.Buffer
+		hpack.NewEncoder(&headers).WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+		framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: headers.Bytes(), EndHeaders: true})
+		// The body is only sent once the client has the response.
+		<-release
+		for i := 0; i < 8; i++ {
+			framer.WriteData(1, i == 7, bytes.Repeat([]byte("a"), 16384))
+		}
+		io.Copy(ioutil.Discard, br)
+	}()
+
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &h2cUpgradeRoundTripper{dial: (&net.Dialer{}).DialContext, recorder: &http2SettingsRecorder{}}
+	resp, err := rt.RoundTrip(req.WithContext(testCTX))
+	close(release)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading body: %s", err)
+	}
+	if n != 8*16384 {
+		t.Fatalf("Expected %d bytes of body, got %d", 8*16384, n)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// ProbeHTTPProxy fetches the configured URL through the forward proxy given
+// as target.
+func ProbeHTTPProxy(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) (success bool) {
+	var (
+		durationGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_http_proxy_duration_seconds",
+			Help: "Duration of the request by phase, for the proxy hop (resolve, connect, tunnel) and upstream (tls, processing, transfer)",
+		}, []string{"phase"})
+		connectStatusCodeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_proxy_connect_status_code",
+			Help: "Response status code of the proxy to the CONNECT request",
+		})
+		proxyStatusCodeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_proxy_status_code",
+			Help: "Response status code of the proxy when it answered the request itself, 0 if it forwarded the upstream response",
+		})
+		statusCodeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_proxy_upstream_status_code",
+			Help: "Response HTTP status code of the upstream server",
+		})
+	)
+	for _, lv := range []string{"resolve", "connect", "tunnel", "tls", "processing", "transfer"} {
+		durationGaugeVec.WithLabelValues(lv)
+	}
+	registry.MustRegister(durationGaugeVec, statusCodeGauge)
+
+	httpConfig := module.HTTPProxy
+	upstreamURL, err := url.Parse(httpConfig.URL)
+	if err != nil {
+		level.Error(logger).Log("msg", "Could not parse upstream URL", "err", err)
+		return false
+	}
+
+	// The target is the proxy, with Squid's port as default.
+	proxyHost, proxyPort, err := net.SplitHostPort(strings.TrimPrefix(target, "http://"))
+	if err != nil {
+		proxyHost, proxyPort = strings.TrimPrefix(target, "http://"), "3128"
+	}
+	ip, lookupTime, err := chooseProtocol(ctx, module.Resolver, httpConfig.IPProtocol, httpConfig.IPProtocolFallback, proxyHost, registry, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error resolving address", "err", err)
+		return false
+	}
+	durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort(ip.String(), proxyPort)}
+
+	tlsConfig, err := pconfig.NewTLSConfig(&httpConfig.TLSConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating TLS configuration", "err", err)
+		return false
+	}
+	httpTransport := &http.Transport{
+		TLSClientConfig:    tlsConfig,
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}
+
+	mode := httpConfig.Mode
+	if mode == "" {
+		mode = "plain"
+		if upstreamURL.Scheme == "https" {
+			mode = "connect"
+		}
+	}
+	var tunnelDone time.Time
+	if mode == "connect" {
+		registry.MustRegister(connectStatusCodeGauge)
+		dialer := &proxyDialer{
+			config: config.ProxyDialer{
+				URL:      pconfig.URL{URL: proxyURL},
+				Username: httpConfig.ProxyUsername,
+				Password: httpConfig.ProxyPassword,
+				Headers:  httpConfig.ProxyHeaders,
+			},
+			dialer: &net.Dialer{},
+			onConnectResponse: func(resp *http.Response) {
+				tunnelDone = time.Now()
+				level.Info(logger).Log("msg", "Received CONNECT response", "status_code", resp.StatusCode)
+				connectStatusCodeGauge.Set(float64(resp.StatusCode))
+			},
+		}
+		httpTransport.DialContext = dialer.DialContext
+	} else {
+		registry.MustRegister(proxyStatusCodeGauge)
+		if httpConfig.ProxyUsername != "" {
+			proxyURL.User = url.UserPassword(httpConfig.ProxyUsername, string(httpConfig.ProxyPassword))
+		}
+		httpTransport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tt := newTransport(httpTransport, httpTransport, logger)
+	client := &http.Client{
+		Transport: tt,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if httpConfig.Method == "" {
+		httpConfig.Method = "GET"
+	}
+	request, err := http.NewRequest(httpConfig.Method, upstreamURL.String(), nil)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating request", "err", err)
+		return false
+	}
+	for key, value := range httpConfig.Headers {
+		if strings.Title(key) == "Host" {
+			request.Host = value
+			continue
+		}
+		request.Header.Set(key, value)
+	}
+	if mode == "plain" {
+		// Requests are sent to the proxy as is.
+		for key, value := range httpConfig.ProxyHeaders {
+			request.Header.Set(key, value)
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:             tt.DNSStart,
+		DNSDone:              tt.DNSDone,
+		ConnectStart:         tt.ConnectStart,
+		ConnectDone:          tt.ConnectDone,
+		GotConn:              tt.GotConn,
+		GotFirstResponseByte: tt.GotFirstResponseByte,
+	}
+	request = request.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	level.Info(logger).Log("msg", "Fetching URL through proxy", "url", upstreamURL.String(), "proxy", proxyURL.Host, "mode", mode)
+	resp, err := client.Do(request)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error for HTTP request through proxy", "err", err)
+		recordError(ctx, err)
+	} else {
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			level.Info(logger).Log("msg", "Failed to read HTTP response body", "err", err)
+		}
+		resp.Body.Close()
+		tt.current.end = time.Now()
+
+		level.Info(logger).Log("msg", "Received HTTP response", "status_code", resp.StatusCode)
+		if mode == "plain" && proxyGeneratedResponse(resp) {
+			// Like a refused CONNECT, this is a failure of the proxy hop
+			// and not an upstream status.
+			level.Error(logger).Log("msg", "Proxy answered the request itself", "status_code", resp.StatusCode)
+			proxyStatusCodeGauge.Set(float64(resp.StatusCode))
+		} else {
+			statusCodeGauge.Set(float64(resp.StatusCode))
+			if len(httpConfig.ValidStatusCodes) != 0 {
+				for _, code := range httpConfig.ValidStatusCodes {
+					if resp.StatusCode == code {
+						success = true
+						break
+					}
+				}
+			} else {
+				success = 200 <= resp.StatusCode && resp.StatusCode < 300
+			}
+			if !success {
+				level.Info(logger).Log("msg", "Invalid HTTP response status code", "status_code", resp.StatusCode)
+				recordFailure(ctx, FailureStatus)
+			}
+		}
+	}
+
+	// Redirects are not followed, so there is a single roundtrip.
+	for _, trace := range tt.traces {
+		if trace.connectDone.IsZero() {
+			continue
+		}
+		durationGaugeVec.WithLabelValues("connect").Add(trace.connectDone.Sub(trace.dnsDone).Seconds())
+		proxyDone := trace.connectDone
+		if !tunnelDone.IsZero() {
+			durationGaugeVec.WithLabelValues("tunnel").Add(tunnelDone.Sub(trace.connectDone).Seconds())
+			proxyDone = tunnelDone
+		}
+		if trace.gotConn.IsZero() {
+			continue
+		}
+		if trace.tls {
+			durationGaugeVec.WithLabelValues("tls").Add(trace.gotConn.Sub(proxyDone).Seconds())
+		}
+		if trace.responseStart.IsZero() {
+			continue
+		}
+		durationGaugeVec.WithLabelValues("processing").Add(trace.responseStart.Sub(trace.gotConn).Seconds())
+		if trace.end.IsZero() {
+			continue
+		}
+		durationGaugeVec.WithLabelValues("transfer").Add(trace.end.Sub(trace.responseStart).Seconds())
+	}
+	return success
+}
+
+// proxyGeneratedResponse reports whether a proxy answered a plain request
+// itself instead of forwarding the response of the upstream server: it asked
+// for credentials, or flagged its own error with Squid's X-Squid-Error header
+// or the error parameter of Proxy-Status (RFC 9209).
+func proxyGeneratedResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusProxyAuthRequired || resp.Header.Get("X-Squid-Error") != "" {
+		return true
+	}
+	for _, member := range strings.Split(strings.Join(resp.Header["Proxy-Status"], ","), ",") {
+		for _, param := range strings.Split(member, ";")[1:] {
+			if strings.HasPrefix(strings.TrimSpace(param), "error=") {
+				return true
+			}
+		}
+	}
+	return false
+}
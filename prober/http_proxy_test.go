@@ -0,0 +1,173 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestHTTPProxyConnect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	proxy := startHTTPConnectProxy(t)
+	defer proxy.Close()
+
+	tests := []struct {
+		username string
+		success  bool
+		results  map[string]float64
+	}{
+		{
+			username: "probe",
+			success:  true,
+			results: map[string]float64{
+				"probe_http_proxy_connect_status_code":  200,
+				"probe_http_proxy_upstream_status_code": 200,
+			},
+		},
+		{
+			username: "intruder",
+			success:  false,
+			results: map[string]float64{
+				"probe_http_proxy_connect_status_code":  407,
+				"probe_http_proxy_upstream_status_code": 0,
+			},
+		},
+	}
+	for i, test := range tests {
+		module := config.Module{
+			HTTPProxy: config.HTTPProxyProbe{
+				IPProtocol:    "ip4",
+				URL:           upstream.URL,
+				ProxyUsername: test.username,
+				ProxyPassword: "secret",
+				ProxyHeaders:  map[string]string{"X-Probe": "blackbox"},
+				TLSConfig:     pconfig.TLSConfig{InsecureSkipVerify: true},
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		registry := prometheus.NewRegistry()
+		if success := ProbeHTTPProxy(testCTX, proxy.Addr().String(), module, registry, log.NewNopLogger()); success != test.success {
+			t.Fatalf("Test %d: expected success %v, got %v", i, test.success, success)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRegistryResults(test.results, mfs, t)
+	}
+}
+
+func TestHTTPProxyPlain(t *testing.T) {
+	// A plain proxy answers requests for absolute URLs itself here.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() || r.URL.Host != "upstream.example.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic cHJvYmU6c2VjcmV0" || r.Header.Get("X-Probe") != "blackbox" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	module := config.Module{
+		HTTPProxy: config.HTTPProxyProbe{
+			IPProtocol:       "ip4",
+			URL:              "http://upstream.example.com/health",
+			ValidStatusCodes: []int{204},
+			ProxyUsername:    "probe",
+			ProxyPassword:    "secret",
+			ProxyHeaders:     map[string]string{"X-Probe": "blackbox"},
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	if !ProbeHTTPProxy(testCTX, proxy.URL, module, registry, log.NewNopLogger()) {
+		t.Fatalf("HTTP proxy module failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if strings.HasSuffix(mf.GetName(), "connect_status_code") {
+			t.Fatalf("Unexpected metric %s in plain mode", mf.GetName())
+		}
+	}
+	expectedResults := map[string]float64{
+		"probe_http_proxy_upstream_status_code": 204,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+}
+
+func TestHTTPProxyPlainProxyError(t *testing.T) {
+	tests := []struct {
+		header                        http.Header
+		statusCode                    int
+		proxyStatusCode, upstreamCode float64
+	}{
+		{header: http.Header{}, statusCode: http.StatusProxyAuthRequired, proxyStatusCode: 407},
+		{header: http.Header{"X-Squid-Error": {"ERR_CONNECT_FAIL 111"}}, statusCode: http.StatusServiceUnavailable, proxyStatusCode: 503},
+		{header: http.Header{"Proxy-Status": {"proxy.example.com; error=dns_timeout"}}, statusCode: http.StatusBadGateway, proxyStatusCode: 502},
+		// Forwarded from the upstream server.
+		{header: http.Header{"Via": {"1.1 proxy.example.com"}}, statusCode: http.StatusServiceUnavailable, upstreamCode: 503},
+	}
+	for i, test := range tests {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for key, values := range test.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(test.statusCode)
+		}))
+		module := config.Module{
+			HTTPProxy: config.HTTPProxyProbe{
+				IPProtocol: "ip4",
+				URL:        "http://upstream.example.com/health",
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		registry := prometheus.NewRegistry()
+		if ProbeHTTPProxy(testCTX, proxy.URL, module, registry, log.NewNopLogger()) {
+			t.Fatalf("Test %d: HTTP proxy module succeeded, expected failure.", i)
+		}
+		cancel()
+		proxy.Close()
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRegistryResults(map[string]float64{
+			"probe_http_proxy_status_code":          test.proxyStatusCode,
+			"probe_http_proxy_upstream_status_code": test.upstreamCode,
+		}, mfs, t)
+	}
+}
@@ -21,9 +21,12 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -70,6 +73,109 @@ func TestHTTPStatusCodes(t *testing.T) {
 	}
 }
 
+func TestHTTPUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "probe.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/status?full", http.StatusFound)
+		case "/status":
+			fmt.Fprintf(w, "host %s query %s", r.Host, r.URL.RawQuery)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		target  string
+		success bool
+	}{
+		{target: "unix://" + socketPath + ":/status?full", success: true},
+		{target: "unix://" + socketPath, success: true},
+		{target: "unix://" + socketPath + ":/missing", success: false},
+		{target: "unix://" + socketPath + ".missing", success: false},
+	}
+	for i, test := range tests {
+		module := config.Module{
+			Timeout: time.Second,
+			HTTP: config.HTTPProbe{
+				IPProtocolFallback:         true,
+				FailIfBodyNotMatchesRegexp: []string{"^host localhost query full$"},
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), time.Second)
+		registry := prometheus.NewRegistry()
+		result := ProbeHTTP(testCTX, test.target, module, registry, log.NewNopLogger())
+		cancel()
+		if result != test.success {
+			t.Fatalf("Test %d: expected success %v, got %v", i, test.success, result)
+		}
+		if !result {
+			continue
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "probe_http_duration_seconds" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				phase := m.GetLabel()[0].GetValue()
+				if phase != "resolve" && phase != "tls" && m.GetGauge().GetValue() <= 0 {
+					t.Errorf("Test %d: expected a %s duration", i, phase)
+				}
+			}
+		}
+	}
+}
+
+func TestHTTPSourceAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.0/8 and binding to interfaces are only available on linux")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		sourceIPAddress string
+		sourceInterface string
+		success         bool
+	}{
+		{sourceIPAddress: "127.0.0.2", success: true},
+		{sourceIPAddress: "127.0.0.2", sourceInterface: "lo", success: true},
+		{sourceIPAddress: "127.0.0.2", sourceInterface: "does-not-exist", success: false},
+		{sourceIPAddress: "not-an-ip", success: false},
+	}
+	for i, test := range tests {
+		module := config.Module{
+			Timeout: time.Second,
+			HTTP: config.HTTPProbe{
+				IPProtocolFallback:         true,
+				SourceIPAddress:            test.sourceIPAddress,
+				SourceInterface:            test.sourceInterface,
+				FailIfBodyNotMatchesRegexp: []string{"^127\\.0\\.0\\.2:"},
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), time.Second)
+		result := ProbeHTTP(testCTX, ts.URL, module, prometheus.NewRegistry(), log.NewNopLogger())
+		cancel()
+		if result != test.success {
+			t.Errorf("Test %d: expected success %v, got %v", i, test.success, result)
+		}
+	}
+}
+
 func TestValidHTTPVersion(t *testing.T) {
 	tests := []struct {
 		ValidHTTPVersions []string
@@ -16,11 +16,16 @@ package prober
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
 	"net"
 	"os"
-	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -33,6 +38,11 @@ import (
 	"github.com/prometheus/blackbox_exporter/config"
 )
 
+const (
+	icmpDefaultPayload = "Prometheus Blackbox Exporter"
+	icmpDefaultMaxMTU  = 1500
+)
+
 var (
 	icmpID            int
 	icmpSequence      uint16
@@ -65,11 +75,8 @@ func getICMPSequence() uint16 {
 
 func ProbeICMP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) (success bool) {
 	var (
-		requestType     icmp.Type
-		replyType       icmp.Type
-		icmpConn        *icmp.PacketConn
-		v4RawConn       *ipv4.RawConn
-		hopLimitFlagSet bool = true
+		requestType icmp.Type
+		replyType   icmp.Type
 
 		durationGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "probe_icmp_duration_seconds",
@@ -80,6 +87,51 @@ func ProbeICMP(ctx context.Context, target string, module config.Module, registr
 			Name: "probe_icmp_reply_hop_limit",
 			Help: "Replied packet hop limit (TTL for ipv4)",
 		})
+
+		packetsSentGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_packets_sent",
+			Help: "Number of echo requests sent",
+		})
+
+		packetsReceivedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_packets_received",
+			Help: "Number of matching echo replies received",
+		})
+
+		packetLossGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_packet_loss_ratio",
+			Help: "Ratio of echo requests that did not get a reply",
+		})
+
+		rttGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_icmp_rtt_seconds",
+			Help: "Round trip time statistics of the echo replies",
+		}, []string{"statistic"})
+
+		jitterGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_jitter_seconds",
+			Help: "Mean absolute difference between consecutive round trip times",
+		})
+
+		packetsCorruptedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_packets_corrupted",
+			Help: "Number of echo replies whose payload did not match the request",
+		})
+
+		replyDSCPGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_reply_dscp",
+			Help: "DSCP of the last echo reply",
+		})
+
+		dscpPreservedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_dscp_preserved",
+			Help: "Indicates if all echo replies carried the DSCP of the requests",
+		})
+
+		pathMTUGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_icmp_path_mtu_bytes",
+			Help: "Largest packet size that reached the target unfragmented",
+		})
 	)
 
 	for _, lv := range []string{"resolve", "setup", "rtt"} {
@@ -87,8 +139,9 @@ func ProbeICMP(ctx context.Context, target string, module config.Module, registr
 	}
 
 	registry.MustRegister(durationGaugeVec)
+	registry.MustRegister(packetsSentGauge, packetsReceivedGauge, packetLossGauge, rttGaugeVec, jitterGauge, packetsCorruptedGauge)
 
-	dstIPAddr, lookupTime, err := chooseProtocol(ctx, module.ICMP.IPProtocol, module.ICMP.IPProtocolFallback, target, registry, logger)
+	dstIPAddr, lookupTime, err := chooseProtocol(ctx, module.Resolver, module.ICMP.IPProtocol, module.ICMP.IPProtocolFallback, target, registry, logger)
 
 	if err != nil {
 		level.Warn(logger).Log("msg", "Error resolving address", "err", err)
@@ -106,255 +159,463 @@ func ProbeICMP(ctx context.Context, target string, module config.Module, registr
 	}
 
 	setupStart := time.Now()
-	level.Info(logger).Log("msg", "Creating socket")
-
-	privileged := true
-	// Unprivileged sockets are supported on Darwin and Linux only.
-	tryUnprivileged := runtime.GOOS == "darwin" || runtime.GOOS == "linux"
 
+	dontFragment := module.ICMP.DontFragment || module.ICMP.PathMTUDiscovery
+	listenerKey := icmpListenerKey{srcIP: "0.0.0.0"}
+	ipHeaderLen := ipv4.HeaderLen
 	if dstIPAddr.IP.To4() == nil {
 		requestType = ipv6.ICMPTypeEchoRequest
 		replyType = ipv6.ICMPTypeEchoReply
+		listenerKey = icmpListenerKey{ipv6: true, dontFragment: dontFragment, srcIP: "::"}
+		ipHeaderLen = ipv6.HeaderLen
+	} else {
+		requestType = ipv4.ICMPTypeEcho
+		replyType = ipv4.ICMPTypeEchoReply
+		// IP header level options can only be set on raw sockets.
+		listenerKey.raw = dontFragment || module.ICMP.TTL != 0 || module.ICMP.DSCP != 0
+	}
+	if srcIP != nil {
+		listenerKey.srcIP = srcIP.String()
+	}
+	listenerKey.iface = module.ICMP.SourceInterface
 
-		if srcIP == nil {
-			srcIP = net.ParseIP("::")
-		}
+	listener, err := getICMPListener(listenerKey, logger)
+	if err != nil {
+		return false
+	}
 
-		if tryUnprivileged {
-			// "udp" here means unprivileged -- not the protocol "udp".
-			icmpConn, err = icmp.ListenPacket("udp6", srcIP.String())
-			if err != nil {
-				level.Debug(logger).Log("msg", "Unable to do unprivileged listen on socket, will attempt privileged", "err", err)
-			} else {
-				privileged = false
-			}
-		}
+	writeOptions := icmpWriteOptions{
+		ttl:          module.ICMP.TTL,
+		tos:          module.ICMP.DSCP << 2,
+		dontFragment: dontFragment,
+	}
 
-		if privileged {
-			icmpConn, err = icmp.ListenPacket("ip6:ipv6-icmp", srcIP.String())
-			if err != nil {
-				level.Error(logger).Log("msg", "Error listening to socket", "err", err)
-				return
-			}
+	packetCount := module.ICMP.PacketCount
+	if packetCount <= 0 {
+		packetCount = 1
+	}
+	interval := module.ICMP.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	replyTimeout := module.ICMP.ReplyTimeout
+	if replyTimeout <= 0 {
+		replyTimeout = time.Second
+	}
+
+	idUnknown := listener.idUnknown()
+
+	// makePackets returns the echo request to send and the echo reply
+	// expected in return for the given sequence number and payload size.
+	makePackets := func(seq, payloadSize int) (request, reply []byte, err error) {
+		payloadProbe := module.ICMP
+		payloadProbe.PayloadSize = payloadSize
+		data, err := icmpPayload(payloadProbe)
+		if err != nil {
+			return nil, nil, err
+		}
+		body := &icmp.Echo{
+			ID:   icmpID,
+			Seq:  seq,
+			Data: data,
+		}
+		level.Info(logger).Log("msg", "Creating ICMP packet", "seq", body.Seq, "id", body.ID)
+		wm := icmp.Message{
+			Type: requestType,
+			Code: 0,
+			Body: body,
+		}
+		request, err = wm.Marshal(nil)
+		if err != nil {
+			return nil, nil, err
 		}
-		defer icmpConn.Close()
 
-		if err := icmpConn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
-			level.Debug(logger).Log("msg", "Failed to set Control Message for retrieving Hop Limit", "err", err)
-			hopLimitFlagSet = false
+		// Reply should be the same except for the message type and ID if
+		// unprivileged sockets were used and the kernel used its own.
+		wm.Type = replyType
+		if idUnknown {
+			body.ID = 0
 		}
-	} else {
-		requestType = ipv4.ICMPTypeEcho
-		replyType = ipv4.ICMPTypeEchoReply
+		reply, err = wm.Marshal(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Clear checksum to make comparison succeed. If the ID is unknown
+		// (due to unprivileged sockets) we also cannot know the checksum in
+		// userspace, and the kernel computes the IPv6 one.
+		reply[2] = 0
+		reply[3] = 0
+		return request, reply, nil
+	}
+
+	durationGaugeVec.WithLabelValues("setup").Add(time.Since(setupStart).Seconds())
 
-		if srcIP == nil {
-			srcIP = net.ParseIP("0.0.0.0")
+	var (
+		sent               int
+		unsent             int
+		corrupted          int
+		rtts               []time.Duration
+		hopLimitRegistered bool
+		dscpRegistered     bool
+		pending            = map[int]time.Time{}
+		expected           = map[int][]byte{}
+		replies            = make(chan icmpReply, packetCount)
+		nextSend           = time.Now()
+	)
+
+	defer func() {
+		for seq := range pending {
+			listener.unregister(listener.waiterKey(dstIPAddr.IP, icmpID, seq))
 		}
 
-		if module.ICMP.DontFragment {
-			// If the user has set the don't fragment option we cannot use unprivileged
-			// sockets as it is not possible to set IP header level options.
-			netConn, err := net.ListenPacket("ip4:icmp", srcIP.String())
-			if err != nil {
-				level.Error(logger).Log("msg", "Error listening to socket", "err", err)
-				return
-			}
-			defer netConn.Close()
+		packetsSentGauge.Set(float64(sent))
+		packetsReceivedGauge.Set(float64(len(rtts)))
+		packetsCorruptedGauge.Set(float64(corrupted))
+		if sent > 0 {
+			packetLossGauge.Set(float64(sent-len(rtts)) / float64(sent))
+		}
+		if len(rtts) == 0 {
+			return
+		}
+		stats := icmpRTTStats(rtts)
+		durationGaugeVec.WithLabelValues("rtt").Add(stats.avg.Seconds())
+		rttGaugeVec.WithLabelValues("min").Set(stats.min.Seconds())
+		rttGaugeVec.WithLabelValues("avg").Set(stats.avg.Seconds())
+		rttGaugeVec.WithLabelValues("max").Set(stats.max.Seconds())
+		rttGaugeVec.WithLabelValues("stddev").Set(stats.stddev.Seconds())
+		jitterGauge.Set(stats.jitter.Seconds())
+	}()
+
+	// Several echo requests, or the path MTU discovery following them, must
+	// not wait for lost replies until the probe times out. Replies are then
+	// waited for up to the reply timeout after the last request.
+	waitForTimeout := packetCount == 1 && !module.ICMP.PathMTUDiscovery
+	var replyDeadline <-chan time.Time
 
-			v4RawConn, err = ipv4.NewRawConn(netConn)
+	level.Info(logger).Log("msg", "Waiting for reply packets")
+	for len(rtts)+corrupted+unsent < packetCount {
+		if sent < packetCount && !time.Now().Before(nextSend) {
+			seq := int(getICMPSequence())
+			wb, reply, err := makePackets(seq, module.ICMP.PayloadSize)
 			if err != nil {
-				level.Error(logger).Log("msg", "Error creating raw connection", "err", err)
+				level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
 				return
 			}
-			defer v4RawConn.Close()
-
-			if err := v4RawConn.SetControlMessage(ipv4.FlagTTL, true); err != nil {
-				level.Debug(logger).Log("msg", "Failed to set Control Message for retrieving TTL", "err", err)
-				hopLimitFlagSet = false
+			level.Info(logger).Log("msg", "Writing out packet", "seq", seq)
+			key := listener.waiterKey(dstIPAddr.IP, icmpID, seq)
+			listener.register(key, replies)
+			expected[seq] = reply
+			pending[seq] = time.Now()
+			if err := listener.writeTo(wb, dstIPAddr, writeOptions); err != nil {
+				// The packet counts as lost.
+				level.Warn(logger).Log("msg", "Error writing to socket", "seq", seq, "err", err)
+				listener.unregister(key)
+				delete(expected, seq)
+				delete(pending, seq)
+				unsent++
 			}
-		} else {
-			if tryUnprivileged {
-				icmpConn, err = icmp.ListenPacket("udp4", srcIP.String())
-				if err != nil {
-					level.Debug(logger).Log("msg", "Unable to do unprivileged listen on socket, will attempt privileged", "err", err)
-				} else {
-					privileged = false
-				}
+			sent++
+			nextSend = nextSend.Add(interval)
+			if sent == packetCount && !waitForTimeout {
+				deadlineTimer := time.NewTimer(replyTimeout)
+				defer deadlineTimer.Stop()
+				replyDeadline = deadlineTimer.C
 			}
+		}
 
-			if privileged {
-				icmpConn, err = icmp.ListenPacket("ip4:icmp", srcIP.String())
-				if err != nil {
-					level.Error(logger).Log("msg", "Error listening to socket", "err", err)
-					return
-				}
+		// Wake up in time to send the next packet, if there is one.
+		var sendTimer <-chan time.Time
+		var timer *time.Timer
+		if sent < packetCount {
+			timer = time.NewTimer(time.Until(nextSend))
+			sendTimer = timer.C
+		}
+
+		var reply icmpReply
+		timedOut := false
+		select {
+		case <-ctx.Done():
+			level.Warn(logger).Log("msg", "Timeout waiting for reply packets", "err", ctx.Err())
+			timedOut = true
+		case <-replyDeadline:
+			level.Warn(logger).Log("msg", "Timeout waiting for reply packets after the last echo request", "timeout", replyTimeout)
+			timedOut = true
+		case <-sendTimer:
+		case reply = <-replies:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if timedOut {
+			if len(rtts) == 0 {
+				recordFailure(ctx, FailureTimeout)
 			}
-			defer icmpConn.Close()
+			break
+		}
+		if reply.data == nil {
+			// Time to send the next packet.
+			continue
+		}
 
-			if err := icmpConn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true); err != nil {
-				level.Debug(logger).Log("msg", "Failed to set Control Message for retrieving TTL", "err", err)
-				hopLimitFlagSet = false
+		rb := reply.data
+		if !isICMPEchoReply(rb[0], listenerKey.ipv6) {
+			level.Warn(logger).Log("msg", "Received ICMP error for echo request", "peer", reply.peer, "type", rb[0], "code", rb[1])
+			continue
+		}
+		if idUnknown {
+			// Clear the ID from the packet, as the kernel will have replaced it (and
+			// kept track of our packet for us, hence clearing is safe).
+			rb[4] = 0
+			rb[5] = 0
+		}
+		rb[2] = 0
+		rb[3] = 0
+		seq := int(rb[6])<<8 | int(rb[7])
+		wb, ok := expected[seq]
+		if !ok {
+			continue
+		}
+		delete(expected, seq)
+		if !bytes.Equal(rb, wb) {
+			level.Error(logger).Log("msg", "Reply packet does not match the request", "seq", seq, "expected", hex.EncodeToString(wb), "got", hex.EncodeToString(rb))
+			corrupted++
+			continue
+		}
+		rtts = append(rtts, reply.received.Sub(pending[seq]))
+		if reply.tos >= 0 {
+			replyDSCP := reply.tos >> 2
+			if !dscpRegistered {
+				registry.MustRegister(replyDSCPGauge, dscpPreservedGauge)
+				dscpRegistered = true
+				dscpPreservedGauge.Set(1)
+			}
+			replyDSCPGauge.Set(float64(replyDSCP))
+			if replyDSCP != module.ICMP.DSCP {
+				level.Warn(logger).Log("msg", "Reply DSCP differs from the request", "seq", seq, "dscp", module.ICMP.DSCP, "reply_dscp", replyDSCP)
+				dscpPreservedGauge.Set(0)
+			}
+		}
+		if reply.hopLimit >= 0 {
+			if !hopLimitRegistered {
+				registry.MustRegister(hopLimitGauge)
+				hopLimitRegistered = true
 			}
+			hopLimitGauge.Set(float64(reply.hopLimit))
+		} else {
+			level.Debug(logger).Log("msg", "Cannot get Hop Limit from the received packet. 'probe_icmp_reply_hop_limit' will be missing.")
 		}
+		level.Info(logger).Log("msg", "Found matching reply packet", "seq", seq)
 	}
 
-	var dst net.Addr = dstIPAddr
-	if !privileged {
-		dst = &net.UDPAddr{IP: dstIPAddr.IP, Zone: dstIPAddr.Zone}
+	if corrupted > 0 {
+		level.Error(logger).Log("msg", "Received corrupted reply packets", "corrupted", corrupted)
+		return false
 	}
-
-	var data []byte
-	if module.ICMP.PayloadSize != 0 {
-		data = make([]byte, module.ICMP.PayloadSize)
-		copy(data, "Prometheus Blackbox Exporter")
-	} else {
-		data = []byte("Prometheus Blackbox Exporter")
+	if len(rtts) == 0 {
+		level.Error(logger).Log("msg", "No echo request was answered", "sent", sent)
+		return false
 	}
-
-	body := &icmp.Echo{
-		ID:   icmpID,
-		Seq:  int(getICMPSequence()),
-		Data: data,
+	if !lossWithinThreshold(sent, len(rtts), module.ICMP.MaxPacketLossRatio, logger) {
+		return false
 	}
-	level.Info(logger).Log("msg", "Creating ICMP packet", "seq", body.Seq, "id", body.ID)
-	wm := icmp.Message{
-		Type: requestType,
-		Code: 0,
-		Body: body,
+	if !module.ICMP.PathMTUDiscovery {
+		return true
 	}
-
-	wb, err := wm.Marshal(nil)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
-		return
+	if ctx.Err() != nil {
+		level.Error(logger).Log("msg", "No time left for path MTU discovery", "err", ctx.Err())
+		return false
 	}
 
-	durationGaugeVec.WithLabelValues("setup").Add(time.Since(setupStart).Seconds())
-	level.Info(logger).Log("msg", "Writing out packet")
-	rttStart := time.Now()
-
-	if icmpConn != nil {
-		_, err = icmpConn.WriteTo(wb, dst)
-	} else {
-		// Only for IPv4 raw. Needed for setting DontFragment flag.
-		header := &ipv4.Header{
-			Version:  ipv4.Version,
-			Len:      ipv4.HeaderLen,
-			Protocol: 1,
-			TotalLen: ipv4.HeaderLen + len(wb),
-			TTL:      64,
-			Dst:      dstIPAddr.IP,
-			Src:      srcIP,
+	// probeMTU sends a single echo request of the given size with the DF
+	// bit set and reports whether it was answered, along with the MTU
+	// reported by an ICMP "fragmentation needed" or "packet too big" error.
+	probeMTU := func(mtu int) (bool, int, error) {
+		seq := int(getICMPSequence())
+		wb, _, err := makePackets(seq, mtu-ipHeaderLen-8)
+		if err != nil {
+			return false, 0, err
 		}
+		ch := make(chan icmpReply, 1)
+		key := listener.waiterKey(dstIPAddr.IP, icmpID, seq)
+		listener.register(key, ch)
+		defer listener.unregister(key)
+		level.Debug(logger).Log("msg", "Probing path MTU", "mtu", mtu, "seq", seq)
+		if err := listener.writeTo(wb, dstIPAddr, writeOptions); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				// Larger than the MTU of the outgoing interface or the
+				// path MTU known to the kernel.
+				return false, 0, nil
+			}
+			return false, 0, err
+		}
+		timer := time.NewTimer(replyTimeout)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false, 0, ctx.Err()
+		case <-timer.C:
+			return false, 0, nil
+		case reply := <-ch:
+			if isICMPEchoReply(reply.data[0], listenerKey.ipv6) {
+				return true, 0, nil
+			}
+			if hint := icmpErrorMTU(reply.data, listenerKey.ipv6); hint > 0 {
+				level.Debug(logger).Log("msg", "Packet too big", "mtu", mtu, "peer", reply.peer, "next_hop_mtu", hint)
+				return false, hint, nil
+			}
+			return false, 0, fmt.Errorf("received ICMP error type %d code %d from %s", reply.data[0], reply.data[1], reply.peer)
+		}
+	}
 
-		header.Flags |= ipv4.DontFragment
-
-		err = v4RawConn.WriteTo(header, wb, nil)
+	maxMTU := module.ICMP.MaxMTU
+	if maxMTU == 0 {
+		maxMTU = icmpDefaultMaxMTU
 	}
-	if err != nil {
-		level.Warn(logger).Log("msg", "Error writing to socket", "err", err)
-		return
+	// The smallest MTU every link must support.
+	minMTU := 68
+	if listenerKey.ipv6 {
+		minMTU = 1280
 	}
-
-	// Reply should be the same except for the message type and ID if
-	// unprivileged sockets were used and the kernel used its own.
-	wm.Type = replyType
-	// Unprivileged cannot set IDs on Linux.
-	idUnknown := !privileged && runtime.GOOS == "linux"
-	if idUnknown {
-		body.ID = 0
+	if minMTU > maxMTU {
+		minMTU = maxMTU
 	}
-	wb, err = wm.Marshal(nil)
+	pathMTU, err := searchPathMTU(minMTU, maxMTU, probeMTU)
 	if err != nil {
-		level.Error(logger).Log("msg", "Error marshalling packet", "err", err)
-		return
+		level.Error(logger).Log("msg", "Error discovering path MTU", "err", err)
+		return false
 	}
-
-	if idUnknown {
-		// If the ID is unknown (due to unprivileged sockets) we also cannot know
-		// the checksum in userspace.
-		wb[2] = 0
-		wb[3] = 0
+	if pathMTU == 0 {
+		level.Error(logger).Log("msg", "No packet reached the target unfragmented", "min_mtu", minMTU)
+		return false
 	}
+	level.Info(logger).Log("msg", "Discovered path MTU", "mtu", pathMTU)
+	registry.MustRegister(pathMTUGauge)
+	pathMTUGauge.Set(float64(pathMTU))
+	return true
+}
 
-	rb := make([]byte, 65536)
-	deadline, _ := ctx.Deadline()
-	if icmpConn != nil {
-		err = icmpConn.SetReadDeadline(deadline)
-	} else {
-		err = v4RawConn.SetReadDeadline(deadline)
-	}
-	if err != nil {
-		level.Error(logger).Log("msg", "Error setting socket deadline", "err", err)
-		return
-	}
-	level.Info(logger).Log("msg", "Waiting for reply packets")
-	for {
-		var n int
-		var peer net.Addr
-		var err error
-		var hopLimit float64 = -1
-
-		if dstIPAddr.IP.To4() == nil {
-			var cm *ipv6.ControlMessage
-			n, cm, peer, err = icmpConn.IPv6PacketConn().ReadFrom(rb)
-			// HopLimit == 0 is valid for IPv6, although go initialize it as 0.
-			if cm != nil && hopLimitFlagSet {
-				hopLimit = float64(cm.HopLimit)
-			} else {
-				level.Debug(logger).Log("msg", "Cannot get Hop Limit from the received packet. 'probe_icmp_reply_hop_limit' will be missing.")
-			}
+// searchPathMTU returns the largest MTU between low and high for which probe
+// succeeds, or 0 if there is none. It first tries high, then bisects, and
+// jumps straight to the MTU reported by a failed probe when it is within the
+// remaining range.
+func searchPathMTU(low, high int, probe func(mtu int) (ok bool, hint int, err error)) (int, error) {
+	best := 0
+	next := high
+	for low <= high {
+		ok, hint, err := probe(next)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			best = next
+			low = next + 1
 		} else {
-			var cm *ipv4.ControlMessage
-			if icmpConn != nil {
-				n, cm, peer, err = icmpConn.IPv4PacketConn().ReadFrom(rb)
-			} else {
-				var h *ipv4.Header
-				var p []byte
-				h, p, cm, err = v4RawConn.ReadFrom(rb)
-				if err == nil {
-					copy(rb, p)
-					n = len(p)
-					peer = &net.IPAddr{IP: h.Src}
-				}
-			}
-			if cm != nil && hopLimitFlagSet {
-				// Not really Hop Limit, but it is in practice.
-				hopLimit = float64(cm.TTL)
-			} else {
-				level.Debug(logger).Log("msg", "Cannot get TTL from the received packet. 'probe_icmp_reply_hop_limit' will be missing.")
+			high = next - 1
+			if hint >= low && hint <= high {
+				high = hint
+				next = hint
+				continue
 			}
 		}
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				level.Warn(logger).Log("msg", "Timeout reading from socket", "err", err)
-				return
-			}
-			level.Error(logger).Log("msg", "Error reading from socket", "err", err)
-			continue
+		next = (low + high + 1) / 2
+	}
+	return best, nil
+}
+
+// icmpPayload returns the echo request payload for the configured pattern.
+func icmpPayload(probe config.ICMPProbe) ([]byte, error) {
+	var pattern []byte
+	switch probe.PayloadPattern {
+	case "random":
+		size := probe.PayloadSize
+		if size == 0 {
+			size = len(icmpDefaultPayload)
 		}
-		if peer.String() != dst.String() {
-			continue
+		data := make([]byte, size)
+		_, err := cryptorand.Read(data)
+		return data, err
+	case "incrementing":
+		size := probe.PayloadSize
+		if size == 0 {
+			size = len(icmpDefaultPayload)
 		}
-		if idUnknown {
-			// Clear the ID from the packet, as the kernel will have replaced it (and
-			// kept track of our packet for us, hence clearing is safe).
-			rb[4] = 0
-			rb[5] = 0
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
 		}
-		if idUnknown || replyType == ipv6.ICMPTypeEchoReply {
-			// Clear checksum to make comparison succeed.
-			rb[2] = 0
-			rb[3] = 0
+		return data, nil
+	case "hex":
+		var err error
+		if pattern, err = hex.DecodeString(probe.PayloadHex); err != nil {
+			return nil, err
 		}
-		if bytes.Equal(rb[:n], wb) {
-			durationGaugeVec.WithLabelValues("rtt").Add(time.Since(rttStart).Seconds())
-			if hopLimit >= 0 {
-				hopLimitGauge.Set(hopLimit)
-				registry.MustRegister(hopLimitGauge)
-			}
-			level.Info(logger).Log("msg", "Found matching reply packet")
-			return true
+		if probe.PayloadSize == 0 {
+			return pattern, nil
+		}
+		// Repeat the pattern to fill the payload.
+		data := make([]byte, probe.PayloadSize)
+		for i := 0; i < len(data); i += len(pattern) {
+			copy(data[i:], pattern)
+		}
+		return data, nil
+	default:
+		if probe.PayloadSize != 0 {
+			data := make([]byte, probe.PayloadSize)
+			copy(data, icmpDefaultPayload)
+			return data, nil
+		}
+		return []byte(icmpDefaultPayload), nil
+	}
+}
+
+// lossWithinThreshold checks the ratio of lost packets against the
+// configured maximum.
+func lossWithinThreshold(sent, received int, maxLossRatio float64, logger log.Logger) bool {
+	lossRatio := float64(sent-received) / float64(sent)
+	if lossRatio > maxLossRatio {
+		level.Error(logger).Log("msg", "Packet loss exceeds threshold", "loss_ratio", lossRatio, "max_packet_loss_ratio", maxLossRatio)
+		return false
+	}
+	return true
+}
+
+// icmpStats summarises the round trip times of the replies of an ICMP probe.
+type icmpStats struct {
+	min, avg, max, stddev, jitter time.Duration
+}
+
+// icmpRTTStats computes the round trip time statistics for the given RTTs,
+// in the order the replies were received. Jitter is the mean absolute
+// difference between consecutive RTTs.
+func icmpRTTStats(rtts []time.Duration) icmpStats {
+	var s icmpStats
+	if len(rtts) == 0 {
+		return s
+	}
+	var sum, jitterSum float64
+	s.min, s.max = rtts[0], rtts[0]
+	for i, rtt := range rtts {
+		if rtt < s.min {
+			s.min = rtt
+		}
+		if rtt > s.max {
+			s.max = rtt
+		}
+		sum += float64(rtt)
+		if i > 0 {
+			jitterSum += math.Abs(float64(rtt - rtts[i-1]))
 		}
 	}
+	avg := sum / float64(len(rtts))
+	var variance float64
+	for _, rtt := range rtts {
+		variance += (float64(rtt) - avg) * (float64(rtt) - avg)
+	}
+	s.avg = time.Duration(avg)
+	s.stddev = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	if len(rtts) > 1 {
+		s.jitter = time.Duration(jitterSum / float64(len(rtts)-1))
+	}
+	return s
 }
@@ -0,0 +1,530 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	icmpRepliesDispatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "blackbox_exporter",
+		Name:      "icmp_replies_dispatched_total",
+		Help:      "Total number of ICMP replies handed to a waiting probe.",
+	})
+	icmpRepliesOrphaned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "blackbox_exporter",
+		Name:      "icmp_replies_orphaned_total",
+		Help:      "Total number of ICMP echo replies for this exporter that no probe was waiting for.",
+	})
+
+	icmpListenersMutex sync.Mutex
+	icmpListeners      = map[icmpListenerKey]*icmpListener{}
+)
+
+func init() {
+	prometheus.MustRegister(icmpRepliesDispatched)
+	prometheus.MustRegister(icmpRepliesOrphaned)
+}
+
+// icmpListenerKey identifies a shared ICMP socket.
+type icmpListenerKey struct {
+	ipv6 bool
+	// raw is set for IPv4 sockets on which the IP header is written by us,
+	// which is needed to set IP header level options.
+	raw bool
+	// dontFragment is set for IPv6 sockets that must not fragment locally.
+	dontFragment bool
+	// privileged is set for sockets that must not be unprivileged, as only
+	// privileged sockets receive the ICMP errors about UDP and TCP packets.
+	privileged bool
+	srcIP      string
+	// iface is the network interface the socket is bound to, if any.
+	iface string
+}
+
+// icmpWaiterKey identifies the reply a probe is waiting for.
+type icmpWaiterKey struct {
+	peer string
+	// proto is 0 for echo requests, and the IP protocol number for UDP and
+	// TCP packets, in which case id and seq are the source and destination
+	// ports.
+	proto int
+	id    int
+	seq   int
+}
+
+// icmpReply is an ICMP message received on a shared socket. Besides echo
+// replies, these are errors about packets we sent, in which case peer is
+// the host reporting the error.
+type icmpReply struct {
+	peer net.IP
+	// data holds the whole ICMP message, starting with the ICMP header.
+	data []byte
+	// hopLimit is the hop limit (TTL for IPv4) of the reply, or -1 if unknown.
+	hopLimit int
+	// tos is the TOS (traffic class for IPv6) of the reply, or -1 if unknown.
+	tos      int
+	received time.Time
+}
+
+// icmpWriteOptions are the IP level options of an outgoing message.
+// Zero values leave the system defaults in place.
+type icmpWriteOptions struct {
+	ttl          int
+	tos          int
+	dontFragment bool
+}
+
+// icmpListener is a long-lived ICMP socket shared by all probes of an
+// address family and source address. A single reader goroutine dispatches
+// the echo replies to the probes waiting for them.
+type icmpListener struct {
+	key        icmpListenerKey
+	privileged bool
+	conn       io.Closer
+	p4         *ipv4.PacketConn
+	p6         *ipv6.PacketConn
+	rawConn    *ipv4.RawConn
+	logger     log.Logger
+
+	mu      sync.Mutex
+	waiters map[icmpWaiterKey]chan<- icmpReply
+}
+
+// getICMPListener returns the shared socket for key, creating it and
+// starting its reader if needed.
+func getICMPListener(key icmpListenerKey, logger log.Logger) (*icmpListener, error) {
+	icmpListenersMutex.Lock()
+	defer icmpListenersMutex.Unlock()
+
+	if l, ok := icmpListeners[key]; ok {
+		return l, nil
+	}
+
+	level.Info(logger).Log("msg", "Creating socket", "src", key.srcIP, "ipv6", key.ipv6, "raw", key.raw, "dont_fragment", key.dontFragment, "privileged", key.privileged, "interface", key.iface)
+	l := &icmpListener{
+		key:        key,
+		privileged: true,
+		waiters:    map[icmpWaiterKey]chan<- icmpReply{},
+		// The socket outlives the probe that created it, so do not log to
+		// the probe's logger from the reader.
+		logger: log.NewNopLogger(),
+	}
+	if err := l.listen(logger); err != nil {
+		return nil, err
+	}
+	icmpListeners[key] = l
+	go l.read()
+	return l, nil
+}
+
+func (l *icmpListener) listen(logger log.Logger) error {
+	var err error
+	// Unprivileged sockets are supported on Darwin and Linux only.
+	tryUnprivileged := runtime.GOOS == "darwin" || runtime.GOOS == "linux"
+
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if l.key.dontFragment {
+			if err := setIPv6DontFragment(c); err != nil {
+				return err
+			}
+		}
+		if l.key.iface != "" {
+			return bindToDeviceControl(l.key.iface)(network, address, c)
+		}
+		return nil
+	}}
+
+	if l.key.raw {
+		// If IP header level options are needed we cannot use unprivileged
+		// sockets as it is not possible to set them.
+		netConn, err := lc.ListenPacket(context.Background(), "ip4:icmp", l.key.srcIP)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error listening to socket", "err", err)
+			return err
+		}
+		l.rawConn, err = ipv4.NewRawConn(netConn)
+		if err != nil {
+			netConn.Close()
+			level.Error(logger).Log("msg", "Error creating raw connection", "err", err)
+			return err
+		}
+		l.conn = l.rawConn
+		if err := l.rawConn.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			level.Debug(logger).Log("msg", "Failed to set Control Message for retrieving TTL", "err", err)
+		}
+		// The TOS is read from the IP header.
+		return nil
+	}
+
+	if l.key.dontFragment || l.key.iface != "" {
+		// The kernel would otherwise fragment packets exceeding the path MTU
+		// before sending them. Setting this, like binding to an interface,
+		// requires a privileged socket.
+		network := "ip4:icmp"
+		if l.key.ipv6 {
+			network = "ip6:ipv6-icmp"
+		}
+		netConn, err := lc.ListenPacket(context.Background(), network, l.key.srcIP)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error listening to socket", "err", err)
+			return err
+		}
+		l.conn = netConn
+		if l.key.ipv6 {
+			l.p6 = ipv6.NewPacketConn(netConn)
+		} else {
+			l.p4 = ipv4.NewPacketConn(netConn)
+		}
+		l.setControlMessages(logger)
+		return nil
+	}
+
+	unprivilegedNetwork, privilegedNetwork := "udp4", "ip4:icmp"
+	if l.key.ipv6 {
+		unprivilegedNetwork, privilegedNetwork = "udp6", "ip6:ipv6-icmp"
+	}
+	var conn *icmp.PacketConn
+	if tryUnprivileged && !l.key.privileged {
+		// "udp" here means unprivileged -- not the protocol "udp".
+		conn, err = icmp.ListenPacket(unprivilegedNetwork, l.key.srcIP)
+		if err != nil {
+			level.Debug(logger).Log("msg", "Unable to do unprivileged listen on socket, will attempt privileged", "err", err)
+		} else {
+			l.privileged = false
+		}
+	}
+	if l.privileged {
+		conn, err = icmp.ListenPacket(privilegedNetwork, l.key.srcIP)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error listening to socket", "err", err)
+			return err
+		}
+	}
+	l.conn = conn
+	l.p4 = conn.IPv4PacketConn()
+	l.p6 = conn.IPv6PacketConn()
+	l.setControlMessages(logger)
+	return nil
+}
+
+func (l *icmpListener) setControlMessages(logger log.Logger) {
+	var err error
+	if l.key.ipv6 {
+		err = l.p6.SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		err = l.p4.SetControlMessage(ipv4.FlagTTL, true)
+	}
+	if err != nil {
+		level.Debug(logger).Log("msg", "Failed to set Control Message for retrieving Hop Limit", "err", err)
+	}
+	if l.key.ipv6 {
+		if err := l.p6.SetControlMessage(ipv6.FlagTrafficClass, true); err != nil {
+			level.Debug(logger).Log("msg", "Failed to set Control Message for retrieving Traffic Class", "err", err)
+		}
+	}
+}
+
+// idUnknown reports whether the kernel replaces the echo ID with its own.
+func (l *icmpListener) idUnknown() bool {
+	// Unprivileged cannot set IDs on Linux.
+	return !l.privileged && runtime.GOOS == "linux"
+}
+
+// register makes replies matching key be sent to ch until unregister is called.
+func (l *icmpListener) register(key icmpWaiterKey, ch chan<- icmpReply) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiters[key] = ch
+}
+
+func (l *icmpListener) unregister(key icmpWaiterKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.waiters, key)
+}
+
+// waiterKey returns the key under which a reply to the echo request with
+// the given ID and sequence number sent to dst is dispatched.
+func (l *icmpListener) waiterKey(dst net.IP, id, seq int) icmpWaiterKey {
+	if l.idUnknown() {
+		id = 0
+	}
+	return icmpWaiterKey{peer: dst.String(), id: id, seq: seq}
+}
+
+// transportWaiterKey returns the key under which ICMP errors about a UDP
+// or TCP packet sent to dst are dispatched.
+func (l *icmpListener) transportWaiterKey(dst net.IP, proto, srcPort, dstPort int) icmpWaiterKey {
+	return icmpWaiterKey{peer: dst.String(), proto: proto, id: srcPort, seq: dstPort}
+}
+
+// writeTo sends the ICMP message wb to dst. IPv4 sockets only honour the
+// options if they are raw.
+func (l *icmpListener) writeTo(wb []byte, dst *net.IPAddr, opts icmpWriteOptions) error {
+	if l.rawConn == nil {
+		var addr net.Addr = dst
+		if !l.privileged {
+			addr = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+		}
+		if l.key.ipv6 {
+			var cm *ipv6.ControlMessage
+			if opts.ttl != 0 || opts.tos != 0 {
+				cm = &ipv6.ControlMessage{HopLimit: opts.ttl, TrafficClass: opts.tos}
+			}
+			_, err := l.p6.WriteTo(wb, cm, addr)
+			return err
+		}
+		_, err := l.p4.WriteTo(wb, nil, addr)
+		return err
+	}
+
+	// Only for IPv4 raw. Needed for setting IP header level options.
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TOS:      opts.tos,
+		Protocol: 1,
+		TotalLen: ipv4.HeaderLen + len(wb),
+		TTL:      64,
+		Dst:      dst.IP,
+		Src:      net.ParseIP(l.key.srcIP),
+	}
+	if opts.ttl != 0 {
+		header.TTL = opts.ttl
+	}
+	if opts.dontFragment {
+		header.Flags |= ipv4.DontFragment
+	}
+
+	return l.rawConn.WriteTo(header, wb, nil)
+}
+
+// read dispatches incoming messages until the socket fails, in which case
+// the listener is dropped so that the next probe creates a new one.
+func (l *icmpListener) read() {
+	defer func() {
+		icmpListenersMutex.Lock()
+		delete(icmpListeners, l.key)
+		icmpListenersMutex.Unlock()
+		l.conn.Close()
+	}()
+
+	rb := make([]byte, 65536)
+	for {
+		var (
+			n        int
+			peer     net.Addr
+			err      error
+			hopLimit = -1
+			tos      = -1
+		)
+		switch {
+		case l.rawConn != nil:
+			var h *ipv4.Header
+			var p []byte
+			var cm *ipv4.ControlMessage
+			h, p, cm, err = l.rawConn.ReadFrom(rb)
+			if err == nil {
+				n = copy(rb, p)
+				peer = &net.IPAddr{IP: h.Src}
+				tos = h.TOS
+			}
+			if cm != nil {
+				hopLimit = cm.TTL
+			}
+		case l.key.ipv6:
+			var cm *ipv6.ControlMessage
+			n, cm, peer, err = l.p6.ReadFrom(rb)
+			// HopLimit == 0 is valid for IPv6, although go initialize it as 0.
+			if cm != nil {
+				hopLimit = cm.HopLimit
+				tos = cm.TrafficClass
+			}
+		default:
+			var cm *ipv4.ControlMessage
+			n, cm, peer, err = l.p4.ReadFrom(rb)
+			if cm != nil {
+				// Not really Hop Limit, but it is in practice.
+				hopLimit = cm.TTL
+			}
+		}
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			level.Error(l.logger).Log("msg", "Error reading from socket", "err", err)
+			return
+		}
+
+		reply := icmpReply{
+			data:     make([]byte, n),
+			hopLimit: hopLimit,
+			tos:      tos,
+			received: time.Now(),
+		}
+		copy(reply.data, rb[:n])
+		switch addr := peer.(type) {
+		case *net.IPAddr:
+			reply.peer = addr.IP
+		case *net.UDPAddr:
+			reply.peer = addr.IP
+		}
+		l.dispatch(reply)
+	}
+}
+
+// dispatch hands an echo reply, or an error about a packet we sent, to the
+// probe waiting for it.
+func (l *icmpListener) dispatch(reply icmpReply) {
+	if len(reply.data) < 8 {
+		return
+	}
+	var key icmpWaiterKey
+	switch {
+	case isICMPEchoReply(reply.data[0], l.key.ipv6):
+		id := int(reply.data[4])<<8 | int(reply.data[5])
+		if !l.idUnknown() && id != icmpID {
+			// Reply to another process on this host.
+			return
+		}
+		key = l.waiterKey(reply.peer, id, int(reply.data[6])<<8|int(reply.data[7]))
+	case isICMPError(reply.data[0], l.key.ipv6):
+		dst, proto, hdr := parseICMPErrorQuote(reply.data, l.key.ipv6)
+		switch {
+		case hdr == nil:
+			return
+		case proto == 6 || proto == 17:
+			key = l.transportWaiterKey(dst, proto, int(hdr[0])<<8|int(hdr[1]), int(hdr[2])<<8|int(hdr[3]))
+			l.mu.Lock()
+			ch, ok := l.waiters[key]
+			l.mu.Unlock()
+			// Errors about UDP and TCP packets of other processes are
+			// received too, so these are not counted as orphaned.
+			if ok {
+				select {
+				case ch <- reply:
+					icmpRepliesDispatched.Inc()
+				default:
+				}
+			}
+			return
+		case (proto == 1 && hdr[0] == byte(ipv4.ICMPTypeEcho)) || (proto == 58 && hdr[0] == byte(ipv6.ICMPTypeEchoRequest)):
+			id := int(hdr[4])<<8 | int(hdr[5])
+			if !l.idUnknown() && id != icmpID {
+				return
+			}
+			key = l.waiterKey(dst, id, int(hdr[6])<<8|int(hdr[7]))
+		default:
+			return
+		}
+	default:
+		return
+	}
+
+	l.mu.Lock()
+	ch, ok := l.waiters[key]
+	l.mu.Unlock()
+	if !ok {
+		icmpRepliesOrphaned.Inc()
+		return
+	}
+	select {
+	case ch <- reply:
+		icmpRepliesDispatched.Inc()
+	default:
+		// The probe is not keeping up with duplicated replies.
+		icmpRepliesOrphaned.Inc()
+	}
+}
+
+func isICMPEchoReply(typ byte, ipv6Message bool) bool {
+	if ipv6Message {
+		return typ == byte(ipv6.ICMPTypeEchoReply)
+	}
+	return typ == byte(ipv4.ICMPTypeEchoReply)
+}
+
+// isICMPError reports whether typ is an error message quoting the packet
+// that caused it.
+func isICMPError(typ byte, ipv6Message bool) bool {
+	if ipv6Message {
+		switch ipv6.ICMPType(typ) {
+		case ipv6.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig, ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypeParameterProblem:
+			return true
+		}
+		return false
+	}
+	switch ipv4.ICMPType(typ) {
+	case ipv4.ICMPTypeDestinationUnreachable, ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// parseICMPErrorQuote returns the destination, the IP protocol number and
+// the first 8 bytes of the transport header of the packet quoted in an ICMP
+// error message, or a nil header if the quote is too short.
+func parseICMPErrorQuote(msg []byte, ipv6Message bool) (net.IP, int, []byte) {
+	// The quoted packet follows the 8 byte ICMP error header.
+	quote := msg[8:]
+	if ipv6Message {
+		// Extension headers are not followed.
+		if len(quote) < ipv6.HeaderLen+8 {
+			return nil, 0, nil
+		}
+		return net.IP(quote[24:40]), int(quote[6]), quote[ipv6.HeaderLen : ipv6.HeaderLen+8]
+	}
+	if len(quote) < ipv4.HeaderLen {
+		return nil, 0, nil
+	}
+	hdrLen := int(quote[0]&0x0f) << 2
+	if len(quote) < hdrLen+8 {
+		return nil, 0, nil
+	}
+	return net.IP(quote[16:20]), int(quote[9]), quote[hdrLen : hdrLen+8]
+}
+
+// icmpErrorMTU returns the MTU reported by a "fragmentation needed" or
+// "packet too big" message, or 0 if msg is neither.
+func icmpErrorMTU(msg []byte, ipv6Message bool) int {
+	if len(msg) < 8 {
+		return 0
+	}
+	if ipv6Message {
+		if msg[0] != byte(ipv6.ICMPTypePacketTooBig) {
+			return 0
+		}
+		return int(msg[4])<<24 | int(msg[5])<<16 | int(msg[6])<<8 | int(msg[7])
+	}
+	// Code 4 is "fragmentation needed and DF set" (RFC 1191).
+	if msg[0] != byte(ipv4.ICMPTypeDestinationUnreachable) || msg[1] != 4 {
+		return 0
+	}
+	return int(msg[6])<<8 | int(msg[7])
+}
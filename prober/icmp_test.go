@@ -0,0 +1,355 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestICMPRTTStats(t *testing.T) {
+	ms := time.Millisecond
+	stats := icmpRTTStats([]time.Duration{10 * ms, 30 * ms, 20 * ms, 20 * ms})
+	expected := icmpStats{
+		min:    10 * ms,
+		avg:    20 * ms,
+		max:    30 * ms,
+		stddev: time.Duration(7071067),
+		jitter: time.Duration(float64(20*ms+10*ms+0) / 3),
+	}
+	if stats != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, stats)
+	}
+
+	if stats := icmpRTTStats([]time.Duration{5 * ms}); stats.stddev != 0 || stats.jitter != 0 || stats.avg != 5*ms {
+		t.Fatalf("Unexpected statistics for a single reply: %+v", stats)
+	}
+}
+
+// canPingLoopback reports whether ICMP sockets can be opened, which
+// requires either raw socket privileges or unprivileged ICMP support.
+func canPingLoopback() bool {
+	for _, network := range []string{"udp4", "ip4:icmp"} {
+		if c, err := icmp.ListenPacket(network, "127.0.0.1"); err == nil {
+			c.Close()
+			return true
+		}
+	}
+	return false
+}
+
+func TestICMPMultiplePackets(t *testing.T) {
+	if !canPingLoopback() {
+		t.Skip("ICMP sockets are not available")
+	}
+
+	module := config.Module{ICMP: config.ICMPProbe{
+		IPProtocol:  "ip4",
+		PacketCount: 3,
+		Interval:    10 * time.Millisecond,
+	}}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !ProbeICMP(testCTX, "127.0.0.1", module, registry, log.NewNopLogger()) {
+		t.Fatalf("ICMP probe failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResults := map[string]float64{
+		"probe_icmp_packets_sent":      3,
+		"probe_icmp_packets_received":  3,
+		"probe_icmp_packet_loss_ratio": 0,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+	expectedMetrics := map[string]map[string]map[string]struct{}{
+		"probe_icmp_rtt_seconds": {
+			"statistic": {
+				"min":    {},
+				"avg":    {},
+				"max":    {},
+				"stddev": {},
+			},
+		},
+		"probe_icmp_jitter_seconds": nil,
+	}
+	checkMetrics(expectedMetrics, mfs, t)
+}
+
+func TestICMPConcurrentProbes(t *testing.T) {
+	if !canPingLoopback() {
+		t.Skip("ICMP sockets are not available")
+	}
+
+	module := config.Module{ICMP: config.ICMPProbe{IPProtocol: "ip4"}}
+	results := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func() {
+			testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			results <- ProbeICMP(testCTX, "127.0.0.1", module, prometheus.NewRegistry(), log.NewNopLogger())
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if !<-results {
+			t.Fatalf("ICMP probe failed, expected success.")
+		}
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestICMPListenerDispatch(t *testing.T) {
+	l := &icmpListener{
+		privileged: true,
+		waiters:    map[icmpWaiterKey]chan<- icmpReply{},
+	}
+	peer := net.ParseIP("192.0.2.1")
+	makeReply := func(id, seq int) icmpReply {
+		wm := icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("test")},
+		}
+		wb, err := wm.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return icmpReply{peer: peer, data: wb}
+	}
+
+	ch := make(chan icmpReply, 1)
+	l.register(l.waiterKey(peer, icmpID, 1), ch)
+
+	dispatched := counterValue(t, icmpRepliesDispatched)
+	orphaned := counterValue(t, icmpRepliesOrphaned)
+
+	// Replies to other processes are neither dispatched nor orphaned.
+	l.dispatch(makeReply(icmpID+1, 1))
+	// Replies nobody waits for are orphaned.
+	l.dispatch(makeReply(icmpID, 2))
+	l.dispatch(makeReply(icmpID, 1))
+
+	select {
+	case reply := <-ch:
+		if seq := int(reply.data[6])<<8 | int(reply.data[7]); seq != 1 {
+			t.Fatalf("Expected reply with sequence 1, got %d", seq)
+		}
+	default:
+		t.Fatalf("Expected reply to be dispatched")
+	}
+	if d := counterValue(t, icmpRepliesDispatched) - dispatched; d != 1 {
+		t.Fatalf("Expected 1 dispatched reply, got %v", d)
+	}
+	if o := counterValue(t, icmpRepliesOrphaned) - orphaned; o != 1 {
+		t.Fatalf("Expected 1 orphaned reply, got %v", o)
+	}
+
+	l.unregister(l.waiterKey(peer, icmpID, 1))
+	l.dispatch(makeReply(icmpID, 1))
+	if o := counterValue(t, icmpRepliesOrphaned) - orphaned; o != 2 {
+		t.Fatalf("Expected 2 orphaned replies, got %v", o)
+	}
+}
+
+func TestICMPPayload(t *testing.T) {
+	tests := []struct {
+		Probe    config.ICMPProbe
+		Expected []byte
+	}{
+		{config.ICMPProbe{}, []byte(icmpDefaultPayload)},
+		{config.ICMPProbe{PayloadSize: 4}, []byte("Prom")},
+		{config.ICMPProbe{PayloadPattern: "incrementing", PayloadSize: 4}, []byte{0, 1, 2, 3}},
+		{config.ICMPProbe{PayloadPattern: "hex", PayloadHex: "cafe"}, []byte{0xca, 0xfe}},
+		{config.ICMPProbe{PayloadPattern: "hex", PayloadHex: "cafe", PayloadSize: 5}, []byte{0xca, 0xfe, 0xca, 0xfe, 0xca}},
+	}
+	for i, test := range tests {
+		data, err := icmpPayload(test.Probe)
+		if err != nil {
+			t.Fatalf("Test %d: %s", i, err)
+		}
+		if !bytes.Equal(data, test.Expected) {
+			t.Fatalf("Test %d: expected payload %x, got %x", i, test.Expected, data)
+		}
+	}
+
+	data, err := icmpPayload(config.ICMPProbe{PayloadPattern: "random", PayloadSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 64 {
+		t.Fatalf("Expected random payload of 64 bytes, got %d", len(data))
+	}
+}
+
+func TestICMPTTLAndDSCP(t *testing.T) {
+	if c, err := net.ListenPacket("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Skip("Raw ICMP sockets are not available")
+	} else {
+		c.Close()
+	}
+
+	module := config.Module{ICMP: config.ICMPProbe{
+		IPProtocol:     "ip4",
+		TTL:            10,
+		DSCP:           46,
+		PayloadPattern: "random",
+		PayloadSize:    100,
+	}}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !ProbeICMP(testCTX, "127.0.0.1", module, registry, log.NewNopLogger()) {
+		t.Fatalf("ICMP probe failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResults := map[string]float64{
+		"probe_icmp_packets_corrupted": 0,
+		"probe_icmp_reply_dscp":        46,
+		"probe_icmp_dscp_preserved":    1,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+}
+
+func TestSearchPathMTU(t *testing.T) {
+	tests := []struct {
+		PathMTU  int
+		Hint     bool
+		Expected int
+		MaxCalls int
+	}{
+		{PathMTU: 1500, Expected: 1500, MaxCalls: 1},
+		{PathMTU: 1400, Hint: true, Expected: 1400, MaxCalls: 2},
+		{PathMTU: 1400, Expected: 1400, MaxCalls: 12},
+		{PathMTU: 1000, Expected: 0, MaxCalls: 12},
+	}
+	for i, test := range tests {
+		calls := 0
+		mtu, err := searchPathMTU(1280, 1500, func(mtu int) (bool, int, error) {
+			calls++
+			if mtu <= test.PathMTU {
+				return true, 0, nil
+			}
+			if test.Hint {
+				return false, test.PathMTU, nil
+			}
+			return false, 0, nil
+		})
+		if err != nil {
+			t.Fatalf("Test %d: %s", i, err)
+		}
+		if mtu != test.Expected {
+			t.Fatalf("Test %d: expected path MTU %d, got %d", i, test.Expected, mtu)
+		}
+		if calls > test.MaxCalls {
+			t.Fatalf("Test %d: expected at most %d probes, got %d", i, test.MaxCalls, calls)
+		}
+	}
+}
+
+func TestICMPErrorDispatch(t *testing.T) {
+	l := &icmpListener{
+		privileged: true,
+		waiters:    map[icmpWaiterKey]chan<- icmpReply{},
+	}
+	dst := net.ParseIP("192.0.2.1").To4()
+	router := net.ParseIP("198.51.100.1")
+
+	echo, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: icmpID, Seq: 1, Data: []byte("test")},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The quoted packet starts with the IPv4 header of the echo request.
+	quote := make([]byte, ipv4.HeaderLen, ipv4.HeaderLen+len(echo))
+	quote[0] = 0x45
+	quote[9] = 1
+	copy(quote[16:20], dst)
+	quote = append(quote, echo...)
+	// Fragmentation needed, with a next-hop MTU of 1400.
+	msg := append([]byte{3, 4, 0, 0, 0, 0, 0x05, 0x78}, quote...)
+
+	ch := make(chan icmpReply, 1)
+	l.register(l.waiterKey(dst, icmpID, 1), ch)
+	l.dispatch(icmpReply{peer: router, data: msg})
+	select {
+	case reply := <-ch:
+		if mtu := icmpErrorMTU(reply.data, false); mtu != 1400 {
+			t.Fatalf("Expected next-hop MTU 1400, got %d", mtu)
+		}
+	default:
+		t.Fatalf("Expected error to be dispatched")
+	}
+}
+
+func TestICMPPathMTUDiscovery(t *testing.T) {
+	for _, target := range []string{"127.0.0.1", "::1"} {
+		network := "ip4:icmp"
+		protocol := "ip4"
+		if target == "::1" {
+			network = "ip6:ipv6-icmp"
+			protocol = "ip6"
+		}
+		if c, err := net.ListenPacket(network, target); err != nil {
+			t.Logf("Raw ICMP sockets are not available for %s", target)
+			continue
+		} else {
+			c.Close()
+		}
+
+		module := config.Module{ICMP: config.ICMPProbe{
+			IPProtocol:       protocol,
+			PathMTUDiscovery: true,
+			MaxMTU:           9000,
+		}}
+		registry := prometheus.NewRegistry()
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !ProbeICMP(testCTX, target, module, registry, log.NewNopLogger()) {
+			t.Fatalf("ICMP probe of %s failed, expected success.", target)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedResults := map[string]float64{
+			// The loopback MTU is larger than the upper bound of the search.
+			"probe_icmp_path_mtu_bytes": 9000,
+		}
+		checkRegistryResults(expectedResults, mfs, t)
+	}
+}
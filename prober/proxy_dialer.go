@@ -0,0 +1,238 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// dialContextFunc dials connections, like net.Dialer.DialContext.
+type dialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// moduleDialContext returns the function probes use to open TCP
+// connections, going through the configured proxy dialer if any.
+func moduleDialContext(module config.Module, dialer *net.Dialer) dialContextFunc {
+	if module.ProxyDialer.URL.URL == nil {
+		return dialer.DialContext
+	}
+	return (&proxyDialer{config: module.ProxyDialer, dialer: dialer}).DialContext
+}
+
+// proxyDialer opens TCP connections through a SOCKS5 or HTTP CONNECT proxy.
+type proxyDialer struct {
+	config config.ProxyDialer
+	// dialer connects to the proxy.
+	dialer *net.Dialer
+	// onConnectResponse, if set, is called with the response to CONNECT.
+	onConnectResponse func(*http.Response)
+}
+
+// DialContext connects to address through the proxy.
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s is not supported through a proxy", network)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.config.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if d.config.URL.Scheme == "socks5" {
+		err = d.socks5Connect(conn, address)
+	} else {
+		conn, err = d.httpConnect(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SOCKS5 reply codes, from RFC 1928.
+var socks5Errors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (d *proxyDialer) socks5Connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Offer username/password authentication only if configured.
+	method := byte(0x00)
+	if d.config.Username != "" {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("error reading SOCKS5 method: %w", err)
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("SOCKS5 proxy refused the authentication method")
+	}
+	if method == 0x02 {
+		user, password := d.config.Username, string(d.config.Password)
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username and password must be at most 255 bytes")
+		}
+		req := append([]byte{0x01, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("error reading SOCKS5 authentication status: %w", err)
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	req = append(req, portBytes...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("error reading SOCKS5 reply: %w", err)
+	}
+	if header[1] != 0x00 {
+		msg, ok := socks5Errors[header[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown error %d", header[1])
+		}
+		if header[1] == 5 {
+			return fmt.Errorf("SOCKS5 proxy: %s: %w", msg, syscall.ECONNREFUSED)
+		}
+		return fmt.Errorf("SOCKS5 proxy: %s", msg)
+	}
+	// Skip the bound address.
+	var n int
+	switch header[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unknown SOCKS5 address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// bufferedConn reads from a buffered reader on top of the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (d *proxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	for key, value := range d.config.Headers {
+		req.Header.Set(key, value)
+	}
+	if d.config.Username != "" {
+		auth := d.config.Username + ":" + string(d.config.Password)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return conn, fmt.Errorf("error reading CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if d.onConnectResponse != nil {
+		d.onConnectResponse(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	// The target might have spoken already.
+	if r.Buffered() > 0 {
+		return bufferedConn{conn, r}, nil
+	}
+	return conn, nil
+}
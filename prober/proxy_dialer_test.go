@@ -0,0 +1,300 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// socks5Handshake is the server side of a SOCKS5 CONNECT with
+// username/password authentication.
+func socks5Handshake(conn net.Conn, r *bufio.Reader) (string, error) {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", err
+	}
+	if greeting[2] != 0x02 {
+		return "", errors.New("username/password authentication not offered")
+	}
+	conn.Write([]byte{0x05, 0x02})
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", err
+	}
+	user := make([]byte, l[1])
+	io.ReadFull(r, user)
+	io.ReadFull(r, l[:1])
+	password := make([]byte, l[0])
+	io.ReadFull(r, password)
+	if string(user) != "probe" || string(password) != "secret" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", errors.New("authentication failed")
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == 0x04 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		io.ReadFull(r, ip)
+		host = ip.String()
+	case 0x03:
+		io.ReadFull(r, l[:1])
+		name := make([]byte, l[0])
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unexpected address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// serveProxy accepts connections on ln, and pipes them to the target the
+// handshake returns.
+func serveProxy(ln net.Listener, handshake func(net.Conn, *bufio.Reader) (string, error), reply func(net.Conn, error)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			target, err := handshake(conn, r)
+			if err != nil {
+				return
+			}
+			// backend.internal only resolves behind the proxy.
+			if host, port, err := net.SplitHostPort(target); err == nil && host == "backend.internal" {
+				target = net.JoinHostPort("127.0.0.1", port)
+			}
+			upstream, err := net.Dial("tcp", target)
+			reply(conn, err)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, r)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func socks5Reply(conn net.Conn, err error) {
+	rep := byte(0x00)
+	if err != nil {
+		rep = 0x05
+	}
+	conn.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+}
+
+func startSOCKS5Proxy(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	go serveProxy(ln, socks5Handshake, socks5Reply)
+	return ln
+}
+
+func startHTTPConnectProxy(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	handshake := func(conn net.Conn, r *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("X-Probe") != "blackbox" || req.Header.Get("Proxy-Authorization") != "Basic cHJvYmU6c2VjcmV0" {
+			fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", errors.New("unexpected request")
+		}
+		return req.Host, nil
+	}
+	reply := func(conn net.Conn, err error) {
+		if err != nil {
+			fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	go serveProxy(ln, handshake, reply)
+	return ln
+}
+
+func proxyDialerConfig(scheme string, ln net.Listener) config.ProxyDialer {
+	pd := config.ProxyDialer{
+		URL:      pconfig.URL{URL: &url.URL{Scheme: scheme, Host: ln.Addr().String()}},
+		Username: "probe",
+		Password: "secret",
+	}
+	if scheme == "http" {
+		pd.Headers = map[string]string{"X-Probe": "blackbox"}
+	}
+	return pd
+}
+
+func TestTCPThroughProxyDialer(t *testing.T) {
+	target, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "hello\n")
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	for _, scheme := range []string{"socks5", "http"} {
+		var ln net.Listener
+		if scheme == "socks5" {
+			ln = startSOCKS5Proxy(t)
+		} else {
+			ln = startHTTPConnectProxy(t)
+		}
+		defer ln.Close()
+
+		module := config.Module{
+			TCP: config.TCPProbe{
+				IPProtocol:    "ip4",
+				QueryResponse: []config.QueryResponse{{Expect: "^hello$"}},
+			},
+			ProxyDialer: proxyDialerConfig(scheme, ln),
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, address := range []string{target.Addr().String(), net.JoinHostPort("backend.internal", port)} {
+			if !ProbeTCP(testCTX, address, module, prometheus.NewRegistry(), log.NewNopLogger()) {
+				t.Errorf("%s: TCP module failed for %s, expected success.", scheme, address)
+			}
+		}
+	}
+}
+
+func TestTCPThroughProxyDialerRefused(t *testing.T) {
+	ln := startSOCKS5Proxy(t)
+	defer ln.Close()
+
+	// A port nobody listens on.
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	closed.Close()
+
+	module := config.Module{
+		TCP:         config.TCPProbe{IPProtocol: "ip4"},
+		ProxyDialer: proxyDialerConfig("socks5", ln),
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx, failure := WithFailureRecorder(testCTX)
+	if ProbeTCP(ctx, closed.Addr().String(), module, prometheus.NewRegistry(), log.NewNopLogger()) {
+		t.Fatalf("TCP module succeeded, expected failure.")
+	}
+	if class := failure.Class(); class != FailureRefused {
+		t.Fatalf("Expected failure class %q, got %q", FailureRefused, class)
+	}
+}
+
+func TestHTTPThroughProxyDialer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	ln := startHTTPConnectProxy(t)
+	defer ln.Close()
+
+	module := config.Module{
+		HTTP:        config.HTTPProbe{IPProtocol: "ip4"},
+		ProxyDialer: proxyDialerConfig("http", ln),
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{ts.URL, "http://" + net.JoinHostPort("backend.internal", u.Port())} {
+		if !ProbeHTTP(testCTX, target, module, prometheus.NewRegistry(), log.NewNopLogger()) {
+			t.Fatalf("HTTP module failed for %s, expected success.", target)
+		}
+	}
+}
+
+func TestDNSThroughProxyDialer(t *testing.T) {
+	server, addr := startDNSServer("tcp", recursiveDNSHandler)
+	defer server.Shutdown()
+	ln := startSOCKS5Proxy(t)
+	defer ln.Close()
+
+	module := config.Module{
+		DNS: config.DNSProbe{
+			IPProtocol:         "ip4",
+			IPProtocolFallback: true,
+			TransportProtocol:  "tcp",
+			QueryName:          "example.com",
+		},
+		ProxyDialer: proxyDialerConfig("socks5", ln),
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, port, _ := net.SplitHostPort(addr.String())
+	for _, target := range []string{addr.String(), net.JoinHostPort("backend.internal", port)} {
+		if !ProbeDNS(testCTX, target, module, prometheus.NewRegistry(), log.NewNopLogger()) {
+			t.Fatalf("DNS module failed for %s, expected success.", target)
+		}
+	}
+	// Over UDP, the proxy dialer cannot be used.
+	module.DNS.TransportProtocol = "udp"
+	if ProbeDNS(testCTX, addr.String(), module, prometheus.NewRegistry(), log.NewNopLogger()) {
+		t.Fatalf("DNS module over UDP succeeded, expected failure.")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errUnixProxyProtocolAddresses is returned for PROXY protocol headers over
+// Unix domain sockets, whose addresses cannot be announced.
+var errUnixProxyProtocolAddresses = errors.New("PROXY protocol over a Unix domain socket requires source_address and destination_address")
+
+// checkUnixProxyProtocol fails unless the addresses of a PROXY protocol
+// header sent over a Unix domain socket are configured.
+func checkUnixProxyProtocol(pp config.ProxyProtocol) error {
+	if pp.Version != 0 && (pp.SourceAddress == "" || pp.DestinationAddress == "") {
+		return errUnixProxyProtocolAddresses
+	}
+	return nil
+}
+
+// proxyProtocolAddr returns the configured address, or the address of the
+// connection if there is none.
+func proxyProtocolAddr(configured string, connAddr net.Addr) (*net.TCPAddr, error) {
+	if configured == "" {
+		addr, ok := connAddr.(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unsupported address %s", connAddr)
+		}
+		return addr, nil
+	}
+	return net.ResolveTCPAddr("tcp", configured)
+}
+
+// proxyProtocolHeader builds the PROXY protocol header announcing a TCP
+// connection from src to dst.
+func proxyProtocolHeader(pp config.ProxyProtocol, src, dst *net.TCPAddr) ([]byte, error) {
+	ipv4 := src.IP.To4() != nil && dst.IP.To4() != nil
+	if pp.Version == 1 {
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, proxyProtocolV1Addr(src.IP, ipv4), proxyProtocolV1Addr(dst.IP, ipv4), src.Port, dst.Port)), nil
+	}
+	if pp.Version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", pp.Version)
+	}
+
+	var addrs []byte
+	family := byte(0x21) // TCP over IPv6.
+	if ipv4 {
+		family = 0x11 // TCP over IPv4.
+		addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+	} else {
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	addrs = append(addrs, ports...)
+	for _, tlv := range pp.TLVs {
+		value := []byte(tlv.Value)
+		if tlv.ValueBytes != "" {
+			var err error
+			if value, err = decodeBytes(tlv.ValueBytes, tlv.BytesEncoding); err != nil {
+				return nil, err
+			}
+		}
+		tlvHeader := make([]byte, 3)
+		tlvHeader[0] = byte(tlv.Type)
+		binary.BigEndian.PutUint16(tlvHeader[1:], uint16(len(value)))
+		addrs = append(append(addrs, tlvHeader...), value...)
+	}
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x21, family) // Version 2, PROXY command.
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	header = append(header, length...)
+	return append(header, addrs...), nil
+}
+
+// proxyProtocolV1Addr formats ip for a version 1 header. Both addresses of a
+// TCP6 header must be IPv6, so IPv4 addresses are then mapped to IPv6.
+func proxyProtocolV1Addr(ip net.IP, ipv4 bool) string {
+	if ip4 := ip.To4(); ip4 != nil && !ipv4 {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyProtocolHeader sends the PROXY protocol header for conn, if
+// configured.
+func writeProxyProtocolHeader(conn net.Conn, pp config.ProxyProtocol) error {
+	if pp.Version == 0 {
+		return nil
+	}
+	src, err := proxyProtocolAddr(pp.SourceAddress, conn.LocalAddr())
+	if err != nil {
+		return err
+	}
+	dst, err := proxyProtocolAddr(pp.DestinationAddress, conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	header, err := proxyProtocolHeader(pp, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(header)
+	return err
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		pp       config.ProxyProtocol
+		src, dst *net.TCPAddr
+		want     string
+	}{
+		{
+			pp:  config.ProxyProtocol{Version: 1},
+			src: v4src, dst: v4dst,
+			want: hex.EncodeToString([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")),
+		},
+		{
+			pp:  config.ProxyProtocol{Version: 1},
+			src: v6src, dst: v6dst,
+			want: hex.EncodeToString([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")),
+		},
+		{
+			pp:  config.ProxyProtocol{Version: 1},
+			src: v4src, dst: v6dst,
+			want: hex.EncodeToString([]byte("PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n")),
+		},
+		{
+			pp:  config.ProxyProtocol{Version: 2},
+			src: v4src, dst: v4dst,
+			want: "0d0a0d0a000d0a515549540a" + "2111000c" + "c0000201c0000202dc0401bb",
+		},
+		{
+			pp: config.ProxyProtocol{Version: 2, TLVs: []config.ProxyProtocolTLV{
+				{Type: 2, Value: "example.com"},
+				{Type: 0xe0, ValueBytes: "0102"},
+			}},
+			src: v6src, dst: v6dst,
+			want: "0d0a0d0a000d0a515549540a" + "21210037" +
+				"20010db8000000000000000000000001" + "20010db8000000000000000000000002" + "dc0401bb" +
+				"02000b" + hex.EncodeToString([]byte("example.com")) + "e000020102",
+		},
+	}
+	for i, test := range tests {
+		header, err := proxyProtocolHeader(test.pp, test.src, test.dst)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %s", i, err)
+		}
+		if got := hex.EncodeToString(header); got != test.want {
+			t.Errorf("Test %d: expected header %s, got %s", i, test.want, got)
+		}
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	ch := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		defer conn.Close()
+		// Signature, version, family and address length, and IPv4 addresses.
+		header := make([]byte, 16+12)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			ch <- nil
+			return
+		}
+		fmt.Fprintf(conn, "hello\n")
+		ch <- header
+	}()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocol:    "ip4",
+			QueryResponse: []config.QueryResponse{{Expect: "^hello$"}},
+		},
+		ProxyProtocol: config.ProxyProtocol{
+			Version:       2,
+			SourceAddress: "198.51.100.7:1234",
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !ProbeTCP(testCTX, ln.Addr().String(), module, prometheus.NewRegistry(), log.NewNopLogger()) {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	header := <-ch
+	want, _ := proxyProtocolHeader(module.ProxyProtocol, &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 1234}, ln.Addr().(*net.TCPAddr))
+	if !bytes.Equal(header, want) {
+		t.Fatalf("Expected header %x, got %x", want, header)
+	}
+}
+
+func TestHTTPProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			ch <- ""
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		header, _ := r.ReadString('\n')
+		// Skip the request.
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		ch <- header
+	}()
+
+	module := config.Module{
+		HTTP: config.HTTPProbe{
+			IPProtocol: "ip4",
+		},
+		ProxyProtocol: config.ProxyProtocol{
+			Version:            1,
+			SourceAddress:      "198.51.100.7:1234",
+			DestinationAddress: "203.0.113.9:80",
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !ProbeHTTP(testCTX, "http://"+ln.Addr().String(), module, prometheus.NewRegistry(), log.NewNopLogger()) {
+		t.Fatalf("HTTP module failed, expected success.")
+	}
+	if header, want := <-ch, "PROXY TCP4 198.51.100.7 203.0.113.9 1234 80\r\n"; header != want {
+		t.Fatalf("Expected header %q, got %q", want, header)
+	}
+}
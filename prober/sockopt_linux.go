@@ -0,0 +1,89 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package prober
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setIPv6DontFragment makes the kernel return EMSGSIZE for packets
+// exceeding the path MTU rather than fragmenting them.
+func setIPv6DontFragment(c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setTTLAndBind sets the TTL (hop limit for IPv6) of the socket and binds
+// it to an ephemeral port on srcIP, which may be nil. The port is returned
+// so that ICMP errors about the packets sent can be matched before connecting.
+func setTTLAndBind(c syscall.RawConn, ipv6 bool, ttl int, srcIP net.IP) (int, error) {
+	var (
+		port int
+		err  error
+	)
+	if cerr := c.Control(func(fd uintptr) {
+		var sa unix.Sockaddr
+		if ipv6 {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+			sa6 := &unix.SockaddrInet6{}
+			copy(sa6.Addr[:], srcIP.To16())
+			sa = sa6
+		} else {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl)
+			sa4 := &unix.SockaddrInet4{}
+			copy(sa4.Addr[:], srcIP.To4())
+			sa = sa4
+		}
+		if err != nil {
+			return
+		}
+		if err = unix.Bind(int(fd), sa); err != nil {
+			return
+		}
+		if sa, err = unix.Getsockname(int(fd)); err != nil {
+			return
+		}
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			port = sa.Port
+		case *unix.SockaddrInet6:
+			port = sa.Port
+		}
+	}); cerr != nil {
+		return 0, cerr
+	}
+	return port, err
+}
+
+// bindToDevice restricts the socket to the network interface iface.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package prober
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func setIPv6DontFragment(c syscall.RawConn) error {
+	return errors.New("setting the don't fragment option for ip6 is only supported on linux")
+}
+
+func setTTLAndBind(c syscall.RawConn, ipv6 bool, ttl int, srcIP net.IP) (int, error) {
+	return 0, errors.New("setting the TTL of TCP connections is only supported on linux")
+}
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return errors.New("binding to a source interface is only supported on linux")
+}
@@ -0,0 +1,377 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// startTLSNegotiators ask the server to switch to TLS using the commands of
+// the application protocol. They return once the server expects a TLS
+// handshake on the connection.
+var startTLSNegotiators = map[string]func(rw io.ReadWriter, serverName string) error{
+	"smtp":     startTLSSMTP,
+	"imap":     startTLSIMAP,
+	"pop3":     startTLSPOP3,
+	"ftp":      startTLSFTP,
+	"xmpp":     startTLSXMPP,
+	"ldap":     startTLSLDAP,
+	"postgres": startTLSPostgres,
+	"mysql":    startTLSMySQL,
+}
+
+func negotiateStartTLS(rw io.ReadWriter, protocol, serverName string) error {
+	negotiate, ok := startTLSNegotiators[protocol]
+	if !ok {
+		return fmt.Errorf("unknown starttls protocol %q", protocol)
+	}
+	return negotiate(rw, serverName)
+}
+
+// readLine reads a line without its line ending.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readCodeReply reads a possibly multi-line reply as used by SMTP and FTP,
+// and returns its code and last line.
+func readCodeReply(r *bufio.Reader) (int, string, error) {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return 0, "", err
+		}
+		if len(line) < 3 {
+			return 0, line, fmt.Errorf("invalid reply %q", line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return 0, line, fmt.Errorf("invalid reply %q", line)
+		}
+		// "220-" continues the reply, "220 " or "220" ends it.
+		if len(line) == 3 || line[3] != '-' {
+			return code, line, nil
+		}
+	}
+}
+
+// expectCodeReply reads a reply and fails unless it has the expected code.
+func expectCodeReply(r *bufio.Reader, want int) error {
+	code, line, err := readCodeReply(r)
+	if err != nil {
+		return err
+	}
+	if code != want {
+		return fmt.Errorf("unexpected reply %q, expected code %d", line, want)
+	}
+	return nil
+}
+
+func startTLSSMTP(rw io.ReadWriter, serverName string) error {
+	r := bufio.NewReader(rw)
+	if err := expectCodeReply(r, 220); err != nil {
+		return fmt.Errorf("reading greeting: %s", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	if _, err := fmt.Fprintf(rw, "EHLO %s\r\n", hostname); err != nil {
+		return err
+	}
+	if err := expectCodeReply(r, 250); err != nil {
+		return fmt.Errorf("reading EHLO reply: %s", err)
+	}
+	if _, err := io.WriteString(rw, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	if err := expectCodeReply(r, 220); err != nil {
+		return fmt.Errorf("reading STARTTLS reply: %s", err)
+	}
+	return nil
+}
+
+func startTLSFTP(rw io.ReadWriter, serverName string) error {
+	r := bufio.NewReader(rw)
+	if err := expectCodeReply(r, 220); err != nil {
+		return fmt.Errorf("reading greeting: %s", err)
+	}
+	if _, err := io.WriteString(rw, "AUTH TLS\r\n"); err != nil {
+		return err
+	}
+	if err := expectCodeReply(r, 234); err != nil {
+		return fmt.Errorf("reading AUTH TLS reply: %s", err)
+	}
+	return nil
+}
+
+func startTLSIMAP(rw io.ReadWriter, serverName string) error {
+	r := bufio.NewReader(rw)
+	line, err := readLine(r)
+	if err != nil {
+		return fmt.Errorf("reading greeting: %s", err)
+	}
+	// The server may have authenticated the client already.
+	if !strings.HasPrefix(line, "* OK") && !strings.HasPrefix(line, "* PREAUTH") {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	if _, err := io.WriteString(rw, "a001 STARTTLS\r\n"); err != nil {
+		return err
+	}
+	// Skip untagged responses until the tagged one.
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return fmt.Errorf("reading STARTTLS reply: %s", err)
+		}
+		if !strings.HasPrefix(line, "a001 ") {
+			continue
+		}
+		if !strings.HasPrefix(line, "a001 OK") {
+			return fmt.Errorf("unexpected STARTTLS reply %q", line)
+		}
+		return nil
+	}
+}
+
+func startTLSPOP3(rw io.ReadWriter, serverName string) error {
+	r := bufio.NewReader(rw)
+	line, err := readLine(r)
+	if err != nil {
+		return fmt.Errorf("reading greeting: %s", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	if _, err := io.WriteString(rw, "STLS\r\n"); err != nil {
+		return err
+	}
+	if line, err = readLine(r); err != nil {
+		return fmt.Errorf("reading STLS reply: %s", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("unexpected STLS reply %q", line)
+	}
+	return nil
+}
+
+// readXMLUntil reads XML tags until one of the given strings was seen, and
+// returns everything read.
+func readXMLUntil(r *bufio.Reader, until ...string) (string, error) {
+	var sb strings.Builder
+	for {
+		s, err := r.ReadString('>')
+		sb.WriteString(s)
+		if err != nil {
+			return sb.String(), err
+		}
+		for _, u := range until {
+			if strings.Contains(sb.String(), u) {
+				return sb.String(), nil
+			}
+		}
+	}
+}
+
+func startTLSXMPP(rw io.ReadWriter, serverName string) error {
+	r := bufio.NewReader(rw)
+	if _, err := fmt.Fprintf(rw, "<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", serverName); err != nil {
+		return err
+	}
+	features, err := readXMLUntil(r, "</stream:features>", "<stream:features/>")
+	if err != nil {
+		return fmt.Errorf("reading stream features: %s", err)
+	}
+	if !strings.Contains(features, "<starttls") {
+		return errors.New("server does not offer STARTTLS")
+	}
+	if _, err := io.WriteString(rw, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"); err != nil {
+		return err
+	}
+	reply, err := readXMLUntil(r, "<proceed", "<failure")
+	if err != nil {
+		return fmt.Errorf("reading STARTTLS reply: %s", err)
+	}
+	if !strings.Contains(reply, "<proceed") {
+		return errors.New("server refused STARTTLS")
+	}
+	return nil
+}
+
+// ldapStartTLSRequest is an LDAP ExtendedRequest with message ID 1 for the
+// StartTLS OID 1.3.6.1.4.1.1466.20037.
+var ldapStartTLSRequest = append([]byte{
+	0x30, 0x1d, // LDAPMessage SEQUENCE
+	0x02, 0x01, 0x01, // messageID INTEGER 1
+	0x77, 0x18, // [APPLICATION 23] ExtendedRequest
+	0x80, 0x16, // [0] requestName
+}, "1.3.6.1.4.1.1466.20037"...)
+
+// parseBERElement splits the first BER element off b.
+func parseBERElement(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, b = b[0], b[1:]
+	length := int(b[0])
+	b = b[1:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(b) < n {
+			return 0, nil, nil, errors.New("invalid BER length")
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if len(b) < length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[:length], b[length:], nil
+}
+
+// readBERMessage reads a complete BER element.
+func readBERMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, errors.New("invalid BER length")
+		}
+		lb := make([]byte, n)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return nil, err
+		}
+		header = append(header, lb...)
+		length = 0
+		for _, c := range lb {
+			length = length<<8 | int(c)
+		}
+	}
+	msg := make([]byte, len(header)+length)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[len(header):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func startTLSLDAP(rw io.ReadWriter, serverName string) error {
+	if _, err := rw.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+	msg, err := readBERMessage(rw)
+	if err != nil {
+		return fmt.Errorf("reading ExtendedResponse: %s", err)
+	}
+	tag, content, _, err := parseBERElement(msg)
+	if err != nil || tag != 0x30 {
+		return errors.New("invalid LDAPMessage")
+	}
+	// Skip the message ID.
+	if _, _, content, err = parseBERElement(content); err != nil {
+		return errors.New("invalid LDAPMessage")
+	}
+	tag, content, _, err = parseBERElement(content)
+	if err != nil || tag != 0x78 {
+		return fmt.Errorf("unexpected LDAP response with tag 0x%x", tag)
+	}
+	tag, result, _, err := parseBERElement(content)
+	if err != nil || tag != 0x0a || len(result) != 1 {
+		return errors.New("invalid ExtendedResponse")
+	}
+	if result[0] != 0 {
+		return fmt.Errorf("StartTLS failed with LDAP result code %d", result[0])
+	}
+	return nil
+}
+
+func startTLSPostgres(rw io.ReadWriter, serverName string) error {
+	// SSLRequest: the message length and the magic code 80877103.
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:], 8)
+	binary.BigEndian.PutUint32(req[4:], 80877103)
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return fmt.Errorf("reading SSLRequest reply: %s", err)
+	}
+	if reply[0] != 'S' {
+		return fmt.Errorf("server refused SSL with reply %q", reply)
+	}
+	return nil
+}
+
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+)
+
+func startTLSMySQL(rw io.ReadWriter, serverName string) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return fmt.Errorf("reading handshake: %s", err)
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(rw, payload); err != nil {
+		return fmt.Errorf("reading handshake: %s", err)
+	}
+	if len(payload) > 3 && payload[0] == 0xff {
+		return fmt.Errorf("server sent error: %s", payload[3:])
+	}
+	if len(payload) == 0 || payload[0] != 10 {
+		return errors.New("unsupported handshake protocol version")
+	}
+	// Skip the server version, connection ID, first part of the auth
+	// plugin data and the filler to get to the capability flags.
+	end := bytes.IndexByte(payload[1:], 0)
+	if end < 0 || len(payload) < 1+end+1+4+8+1+2 {
+		return errors.New("invalid handshake")
+	}
+	capabilities := binary.LittleEndian.Uint16(payload[1+end+1+4+8+1:])
+	if capabilities&mysqlClientSSL == 0 {
+		return errors.New("server does not support SSL")
+	}
+	// SSLRequest: capabilities, max packet size, character set and filler.
+	req := make([]byte, 4+32)
+	req[0] = 32
+	req[3] = header[3] + 1
+	binary.LittleEndian.PutUint32(req[4:], mysqlClientLongPassword|mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection)
+	binary.LittleEndian.PutUint32(req[8:], 1<<24)
+	req[12] = 33 // utf8_general_ci
+	_, err := rw.Write(req)
+	return err
+}
@@ -0,0 +1,306 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// expectLine reads a line and fails unless it starts with prefix.
+func expectLine(r *bufio.Reader, prefix string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, prefix) {
+		return fmt.Errorf("got %q, expected %q", line, prefix)
+	}
+	return nil
+}
+
+// startTLSServerDialogs implement the server side of each negotiation.
+var startTLSServerDialogs = map[string]func(conn net.Conn, r *bufio.Reader) error{
+	"smtp": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprintf(conn, "220-mail.example.net ESMTP\r\n220 ready\r\n")
+		if err := expectLine(r, "EHLO "); err != nil {
+			return err
+		}
+		fmt.Fprintf(conn, "250-mail.example.net\r\n250-STARTTLS\r\n250 DSN\r\n")
+		if err := expectLine(r, "STARTTLS\r\n"); err != nil {
+			return err
+		}
+		fmt.Fprintf(conn, "220 2.0.0 Ready to start TLS\r\n")
+		return nil
+	},
+	"imap": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprintf(conn, "* OK IMAP4rev1 ready\r\n")
+		if err := expectLine(r, "a001 STARTTLS\r\n"); err != nil {
+			return err
+		}
+		fmt.Fprintf(conn, "* CAPABILITY IMAP4rev1\r\na001 OK Begin TLS negotiation now\r\n")
+		return nil
+	},
+	"pop3": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprintf(conn, "+OK POP3 ready\r\n")
+		if err := expectLine(r, "STLS\r\n"); err != nil {
+			return err
+		}
+		fmt.Fprintf(conn, "+OK Begin TLS negotiation\r\n")
+		return nil
+	},
+	"ftp": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprintf(conn, "220 FTP ready\r\n")
+		if err := expectLine(r, "AUTH TLS\r\n"); err != nil {
+			return err
+		}
+		fmt.Fprintf(conn, "234 AUTH TLS successful\r\n")
+		return nil
+	},
+	"xmpp": func(conn net.Conn, r *bufio.Reader) error {
+		header, err := r.ReadString('>')
+		if err != nil {
+			return err
+		}
+		if header, err = r.ReadString('>'); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(header, "<stream:stream to='127.0.0.1'") {
+			return fmt.Errorf("unexpected stream header %q", header)
+		}
+		fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream from='127.0.0.1' id='1' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>")
+		fmt.Fprintf(conn, "<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls></stream:features>")
+		if _, err := r.ReadString('>'); err != nil {
+			return err
+		}
+		fmt.Fprintf(conn, "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+		return nil
+	},
+	"ldap": func(conn net.Conn, r *bufio.Reader) error {
+		req := make([]byte, len(ldapStartTLSRequest))
+		if _, err := io.ReadFull(r, req); err != nil {
+			return err
+		}
+		if !bytes.Equal(req, ldapStartTLSRequest) {
+			return fmt.Errorf("unexpected request %x", req)
+		}
+		// ExtendedResponse with resultCode success and the OID.
+		resp := append([]byte{0x30, 0x24, 0x02, 0x01, 0x01, 0x78, 0x1f, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00, 0x8a, 0x16}, "1.3.6.1.4.1.1466.20037"...)
+		_, err := conn.Write(resp)
+		return err
+	},
+	"postgres": func(conn net.Conn, r *bufio.Reader) error {
+		req := make([]byte, 8)
+		if _, err := io.ReadFull(r, req); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(req[4:]) != 80877103 {
+			return fmt.Errorf("unexpected request %x", req)
+		}
+		_, err := conn.Write([]byte("S"))
+		return err
+	},
+	"mysql": func(conn net.Conn, r *bufio.Reader) error {
+		payload := []byte{10}
+		payload = append(payload, "8.0.21\x00"...)
+		payload = append(payload, 1, 0, 0, 0)
+		payload = append(payload, "abcdefgh\x00"...)
+		payload = append(payload, 0xff, 0xff)
+		conn.Write(append([]byte{byte(len(payload)), 0, 0, 0}, payload...))
+		req := make([]byte, 36)
+		if _, err := io.ReadFull(r, req); err != nil {
+			return err
+		}
+		if req[0] != 32 || req[3] != 1 || binary.LittleEndian.Uint32(req[4:])&mysqlClientSSL == 0 {
+			return fmt.Errorf("unexpected SSLRequest %x", req)
+		}
+		return nil
+	},
+}
+
+func TestTCPStartTLSProtocols(t *testing.T) {
+	certExpiry := time.Now().AddDate(0, 0, 1)
+	testCertTmpl := generateCertificateTemplate(certExpiry, true)
+	_, testCertPem, testKey := generateSelfSignedCertificate(testCertTmpl)
+	testKeyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKey)})
+	testCert, err := tls.X509KeyPair(testCertPem, testKeyPem)
+	if err != nil {
+		t.Fatalf("Failed to decode TLS testing keypair: %s", err)
+	}
+
+	for protocol, dialog := range startTLSServerDialogs {
+		t.Run(protocol, func(t *testing.T) {
+			ln, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Error listening on socket: %s", err)
+			}
+			defer ln.Close()
+
+			ch := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					ch <- err
+					return
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				r := bufio.NewReader(conn)
+				if err := dialog(conn, r); err != nil {
+					ch <- err
+					return
+				}
+				// The client hello might already be buffered.
+				tlsConn := tls.Server(bufferedConn{conn, r}, &tls.Config{Certificates: []tls.Certificate{testCert}})
+				if err := tlsConn.Handshake(); err != nil {
+					ch <- err
+					return
+				}
+				// Continue encrypted.
+				fmt.Fprintf(tlsConn, "hello\n")
+				ch <- nil
+			}()
+
+			module := config.Module{
+				TCP: config.TCPProbe{
+					IPProtocol:       "ip4",
+					StartTLSProtocol: protocol,
+					TLSConfig:        pconfig.TLSConfig{InsecureSkipVerify: true},
+					QueryResponse:    []config.QueryResponse{{Expect: "^hello$"}},
+				},
+			}
+			testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			registry := prometheus.NewRegistry()
+			if !ProbeTCP(testCTX, ln.Addr().String(), module, registry, log.NewNopLogger()) {
+				t.Fatalf("TCP module failed, expected success.")
+			}
+			if err := <-ch; err != nil {
+				t.Fatalf("Server failed: %s", err)
+			}
+			mfs, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedResults := map[string]float64{
+				"probe_ssl_earliest_cert_expiry": float64(certExpiry.Unix()),
+			}
+			checkRegistryResults(expectedResults, mfs, t)
+		})
+	}
+}
+
+func TestTCPStartTLSRefused(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprintf(conn, "250 mail.example.net\r\n")
+		r.ReadString('\n')
+		fmt.Fprintf(conn, "454 TLS not available\r\n")
+	}()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocol:       "ip4",
+			StartTLSProtocol: "smtp",
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if ProbeTCP(testCTX, ln.Addr().String(), module, prometheus.NewRegistry(), log.NewNopLogger()) {
+		t.Fatalf("TCP module succeeded, expected failure.")
+	}
+}
+
+func TestStartTLSIMAPPreauth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		fmt.Fprintf(server, "* PREAUTH IMAP4rev1 logged in as user\r\n")
+		if err := expectLine(r, "a001 STARTTLS\r\n"); err != nil {
+			return
+		}
+		fmt.Fprintf(server, "a001 OK Begin TLS negotiation now\r\n")
+	}()
+	if err := negotiateStartTLS(client, "imap", "mail.example.net"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestTCPStartTLSXMPPServerName(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			ch <- ""
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		r.ReadString('>')
+		header, _ := r.ReadString('>')
+		ch <- header
+	}()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocol:       "ip4",
+			StartTLSProtocol: "xmpp",
+			TLSConfig:        pconfig.TLSConfig{ServerName: "xmpp.example.net"},
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if ProbeTCP(testCTX, ln.Addr().String(), module, prometheus.NewRegistry(), log.NewNopLogger()) {
+		t.Fatalf("TCP module succeeded, expected failure.")
+	}
+	if header := <-ch; !strings.HasPrefix(header, "<stream:stream to='xmpp.example.net'") {
+		t.Fatalf("Unexpected stream header %q", header)
+	}
+}
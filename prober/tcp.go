@@ -15,11 +15,16 @@ package prober
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -29,42 +34,93 @@ import (
 	"github.com/prometheus/blackbox_exporter/config"
 )
 
-func dialTCP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) (net.Conn, error) {
-	var dialProtocol, dialTarget string
+// errUnixTLSServerName is returned for TLS over Unix domain sockets, which
+// have no host name to verify the certificate against.
+var errUnixTLSServerName = errors.New("TLS over a Unix domain socket requires server_name in tls_config")
+
+func dialTCP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, durationGaugeVec *prometheus.GaugeVec, logger log.Logger) (net.Conn, error) {
+	var dialProtocol, dialTarget, targetAddress, port string
+	var he *happyEyeballs
 	dialer := &net.Dialer{}
-	targetAddress, port, err := net.SplitHostPort(target)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error splitting target address and port", "err", err)
-		return nil, err
-	}
+	if socketPath, _, ok := splitUnixTarget(target); ok {
+		if err := checkUnixProxyProtocol(module.ProxyProtocol); err != nil {
+			level.Error(logger).Log("msg", "Error sending PROXY protocol header", "err", err)
+			return nil, err
+		}
+		// Unix domain sockets need no name resolution.
+		dialProtocol, dialTarget = "unix", socketPath
+	} else {
+		var err error
+		targetAddress, port, err = net.SplitHostPort(target)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error splitting target address and port", "err", err)
+			return nil, err
+		}
 
-	ip, _, err := chooseProtocol(ctx, module.TCP.IPProtocol, module.TCP.IPProtocolFallback, targetAddress, registry, logger)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error resolving address", "err", err)
-		return nil, err
-	}
+		if module.ProxyDialer.URL.URL != nil {
+			// The proxy resolves the target, whose name might only be known
+			// behind it.
+			dialProtocol, dialTarget = "tcp", net.JoinHostPort(targetAddress, port)
+		} else if module.TCP.HappyEyeballs {
+			var lookupTime float64
+			he, lookupTime, err = newHappyEyeballs(ctx, module.Resolver, targetAddress, module.TCP.IPProtocol, module.TCP.HappyEyeballsAttemptDelay, registry, logger)
+			durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error resolving address", "err", err)
+				return nil, err
+			}
+		} else {
+			ip, lookupTime, err := chooseProtocol(ctx, module.Resolver, module.TCP.IPProtocol, module.TCP.IPProtocolFallback, targetAddress, registry, logger)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error resolving address", "err", err)
+				return nil, err
+			}
+			durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
 
-	if ip.IP.To4() == nil {
-		dialProtocol = "tcp6"
-	} else {
-		dialProtocol = "tcp4"
-	}
+			if ip.IP.To4() == nil {
+				dialProtocol = "tcp6"
+			} else {
+				dialProtocol = "tcp4"
+			}
+			dialTarget = net.JoinHostPort(ip.String(), port)
+		}
 
-	if len(module.TCP.SourceIPAddress) > 0 {
-		srcIP := net.ParseIP(module.TCP.SourceIPAddress)
-		if srcIP == nil {
-			level.Error(logger).Log("msg", "Error parsing source ip address", "srcIP", module.TCP.SourceIPAddress)
-			return nil, fmt.Errorf("error parsing source ip address: %s", module.TCP.SourceIPAddress)
+		if len(module.TCP.SourceIPAddress) > 0 {
+			srcIP := net.ParseIP(module.TCP.SourceIPAddress)
+			if srcIP == nil {
+				level.Error(logger).Log("msg", "Error parsing source ip address", "srcIP", module.TCP.SourceIPAddress)
+				return nil, fmt.Errorf("error parsing source ip address: %s", module.TCP.SourceIPAddress)
+			}
+			level.Info(logger).Log("msg", "Using local address", "srcIP", srcIP)
+			dialer.LocalAddr = &net.TCPAddr{IP: srcIP}
+		}
+		if len(module.TCP.SourceInterface) > 0 {
+			level.Info(logger).Log("msg", "Using source interface", "interface", module.TCP.SourceInterface)
+			dialer.Control = bindToDeviceControl(module.TCP.SourceInterface)
+		}
+	}
+	dial := moduleDialContext(module, dialer)
+	if he != nil {
+		// Race the addresses of the target instead of dialing one.
+		raced := dial
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return he.dial(ctx, raced, port)
 		}
-		level.Info(logger).Log("msg", "Using local address", "srcIP", srcIP)
-		dialer.LocalAddr = &net.TCPAddr{IP: srcIP}
 	}
-
-	dialTarget = net.JoinHostPort(ip.String(), port)
 
 	if !module.TCP.TLS {
 		level.Info(logger).Log("msg", "Dialing TCP without TLS")
-		return dialer.DialContext(ctx, dialProtocol, dialTarget)
+		connectStart := time.Now()
+		conn, err := dial(ctx, dialProtocol, dialTarget)
+		durationGaugeVec.WithLabelValues("connect").Add(time.Since(connectStart).Seconds())
+		if err != nil {
+			return nil, err
+		}
+		if err := writeProxyProtocolHeader(conn, module.ProxyProtocol); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error sending PROXY protocol header: %s", err)
+		}
+		return conn, nil
 	}
 	tlsConfig, err := pconfig.NewTLSConfig(&module.TCP.TLSConfig)
 	if err != nil {
@@ -72,6 +128,11 @@ func dialTCP(ctx context.Context, target string, module config.Module, registry
 		return nil, err
 	}
 
+	if len(tlsConfig.ServerName) == 0 && dialProtocol == "unix" && !tlsConfig.InsecureSkipVerify {
+		err := errUnixTLSServerName
+		level.Error(logger).Log("msg", "Error creating TLS configuration", "err", err)
+		return nil, err
+	}
 	if len(tlsConfig.ServerName) == 0 {
 		// If there is no `server_name` in tls_config, use
 		// targetAddress as TLS-servername. Normally tls.DialWithDialer
@@ -82,11 +143,35 @@ func dialTCP(ctx context.Context, target string, module config.Module, registry
 		// via tlsConfig to enable hostname verification.
 		tlsConfig.ServerName = targetAddress
 	}
-	timeoutDeadline, _ := ctx.Deadline()
-	dialer.Deadline = timeoutDeadline
 
 	level.Info(logger).Log("msg", "Dialing TCP with TLS")
-	return tls.DialWithDialer(dialer, dialProtocol, dialTarget, tlsConfig)
+	connectStart := time.Now()
+	conn, err := dial(ctx, dialProtocol, dialTarget)
+	durationGaugeVec.WithLabelValues("connect").Add(time.Since(connectStart).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if err := writeProxyProtocolHeader(conn, module.ProxyProtocol); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending PROXY protocol header: %s", err)
+	}
+
+	// The handshake is timed separately from the connection.
+	timeoutDeadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(timeoutDeadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsStart := time.Now()
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.Handshake()
+	durationGaugeVec.WithLabelValues("tls").Add(time.Since(tlsStart).Seconds())
+	if err != nil {
+		recordFailure(ctx, FailureTLSHandshake)
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 func ProbeTCP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
@@ -116,12 +201,24 @@ func ProbeTCP(ctx context.Context, target string, module config.Module, registry
 		Name: "probe_failed_due_to_regex",
 		Help: "Indicates if probe failed due to regex",
 	})
-	registry.MustRegister(probeFailedDueToRegex)
+	durationGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_tcp_duration_seconds",
+		Help: "Duration of tcp connection by phase",
+	}, []string{"phase"})
+	probeStepDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_tcp_step_duration_seconds",
+		Help: "Duration of each query_response step",
+	}, []string{"step"})
+	for _, lv := range []string{"resolve", "connect", "tls"} {
+		durationGaugeVec.WithLabelValues(lv)
+	}
+	registry.MustRegister(probeFailedDueToRegex, durationGaugeVec, probeStepDuration)
 	deadline, _ := ctx.Deadline()
 
-	conn, err := dialTCP(ctx, target, module, registry, logger)
+	conn, err := dialTCP(ctx, target, module, registry, durationGaugeVec, logger)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error dialing TCP", "err", err)
+		recordError(ctx, err)
 		return false
 	}
 	defer conn.Close()
@@ -134,85 +231,238 @@ func ProbeTCP(ctx context.Context, target string, module config.Module, registry
 		level.Error(logger).Log("msg", "Error setting deadline", "err", err)
 		return false
 	}
-	if module.TCP.TLS {
-		state := conn.(*tls.Conn).ConnectionState()
-		registry.MustRegister(probeSSLEarliestCertExpiry, probeTLSVersion, probeSSLLastChainExpiryTimestampSeconds, probeSSLLastInformation)
+	tlsMetricsRegistered := false
+	setTLSMetrics := func(state tls.ConnectionState) {
+		if !tlsMetricsRegistered {
+			registry.MustRegister(probeSSLEarliestCertExpiry, probeTLSVersion, probeSSLLastChainExpiryTimestampSeconds, probeSSLLastInformation)
+			tlsMetricsRegistered = true
+		}
 		probeSSLEarliestCertExpiry.Set(float64(getEarliestCertExpiry(&state).Unix()))
 		probeTLSVersion.WithLabelValues(getTLSVersion(&state)).Set(1)
 		probeSSLLastChainExpiryTimestampSeconds.Set(float64(getLastChainExpiry(&state).Unix()))
 		probeSSLLastInformation.WithLabelValues(getFingerprint(&state)).Set(1)
 	}
-	scanner := bufio.NewScanner(conn)
+	if module.TCP.TLS {
+		setTLSMetrics(conn.(*tls.Conn).ConnectionState())
+	}
+	if module.TCP.StartTLSProtocol != "" {
+		level.Info(logger).Log("msg", "Negotiating STARTTLS", "protocol", module.TCP.StartTLSProtocol)
+		// The server name is announced by some protocols, like XMPP.
+		serverName := module.TCP.TLSConfig.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(target) // Had succeeded in dialTCP already.
+		}
+		if err := negotiateStartTLS(conn, module.TCP.StartTLSProtocol, serverName); err != nil {
+			level.Error(logger).Log("msg", "STARTTLS negotiation failed", "protocol", module.TCP.StartTLSProtocol, "err", err)
+			recordError(ctx, err)
+			return false
+		}
+		tlsConn, err := upgradeTLS(conn, target, module, durationGaugeVec)
+		if err != nil {
+			level.Error(logger).Log("msg", "TLS Handshake (client) failed", "err", err)
+			recordFailure(ctx, FailureTLSHandshake)
+			return false
+		}
+		defer tlsConn.Close()
+		level.Info(logger).Log("msg", "TLS Handshake (client) succeeded.")
+		conn = tlsConn
+		setTLSMetrics(tlsConn.ConnectionState())
+	}
+	reader := bufio.NewReader(conn)
+	extractor := newMetricExtractor(logger)
+	defer extractor.register(registry)
+
+	step := -1
+	var stepStart time.Time
+	endStep := func() {
+		if step >= 0 {
+			probeStepDuration.WithLabelValues(strconv.Itoa(step)).Set(time.Since(stepStart).Seconds())
+			step = -1
+		}
+	}
+	// Also record the duration of the step the probe failed in.
+	defer endStep()
+
 	for i, qr := range module.TCP.QueryResponse {
 		level.Info(logger).Log("msg", "Processing query response entry", "entry_number", i)
+		step, stepStart = i, time.Now()
+		stepDeadline := deadline
+		if qr.Timeout > 0 && stepStart.Add(qr.Timeout).Before(deadline) {
+			stepDeadline = stepStart.Add(qr.Timeout)
+		}
+		if err := conn.SetDeadline(stepDeadline); err != nil {
+			level.Error(logger).Log("msg", "Error setting deadline", "err", err)
+			return false
+		}
 		send := qr.Send
-		if qr.Expect != "" {
-			re, err := regexp.Compile(qr.Expect)
+		// Steps with metrics but nothing to expect read a single line.
+		if qr.Expect != "" || qr.ExpectBytes != "" || len(qr.Metrics) > 0 {
+			var re *regexp.Regexp
+			if qr.Expect != "" {
+				re, err = regexp.Compile(qr.Expect)
+				if err != nil {
+					level.Error(logger).Log("msg", "Could not compile into regular expression", "regexp", qr.Expect, "err", err)
+					return false
+				}
+			}
+			expectBytes, err := decodeBytes(qr.ExpectBytes, qr.BytesEncoding)
 			if err != nil {
-				level.Error(logger).Log("msg", "Could not compile into regular expression", "regexp", qr.Expect, "err", err)
+				level.Error(logger).Log("msg", "Could not decode expected bytes", "err", err)
 				return false
 			}
-			var match []int
-			// Read lines until one of them matches the configured regexp.
-			for scanner.Scan() {
-				level.Debug(logger).Log("msg", "Read line", "line", scanner.Text())
-				match = re.FindSubmatchIndex(scanner.Bytes())
-				if match != nil {
-					level.Info(logger).Log("msg", "Regexp matched", "regexp", re, "line", scanner.Text())
+			var (
+				frame   []byte
+				frames  [][]byte
+				match   []int
+				matched bool
+			)
+			// Read lines until one of them matches the configured regexp
+			// and contains the expected bytes.
+			for {
+				if frame, err = readFrame(reader, qr); err != nil {
 					break
 				}
+				level.Debug(logger).Log("msg", "Read line", "line", string(frame))
+				frames = append(frames, frame)
+				if expectBytes != nil && !bytes.Contains(frame, expectBytes) {
+					continue
+				}
+				if re != nil {
+					if match = re.FindSubmatchIndex(frame); match == nil {
+						continue
+					}
+				}
+				matched = true
+				level.Info(logger).Log("msg", "Regexp matched", "regexp", re, "line", string(frame))
+				break
+			}
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				level.Error(logger).Log("msg", "Error reading from connection", "err", err.Error())
+				recordError(ctx, err)
+				return false
 			}
-			if scanner.Err() != nil {
-				level.Error(logger).Log("msg", "Error reading from connection", "err", scanner.Err().Error())
+			if !matched && re == nil && expectBytes == nil {
+				level.Error(logger).Log("msg", "No line read for metrics", "err", err)
 				return false
 			}
-			if match == nil {
+			if !matched {
 				probeFailedDueToRegex.Set(1)
-				level.Error(logger).Log("msg", "Regexp did not match", "regexp", re, "line", scanner.Text())
+				level.Error(logger).Log("msg", "Regexp did not match", "regexp", re, "line", string(frame))
 				return false
 			}
 			probeFailedDueToRegex.Set(0)
-			send = string(re.Expand(nil, []byte(send), scanner.Bytes(), match))
+			if re != nil {
+				send = string(re.Expand(nil, []byte(send), frame, match))
+			}
+			for _, m := range qr.Metrics {
+				if m.Regexp == "" {
+					if re != nil {
+						extractor.add(m, re, frame, match)
+					}
+					continue
+				}
+				// Other regexps apply to all the lines read in this step.
+				if err := extractor.extract(m, bytes.Join(frames, []byte("\n"))); err != nil {
+					level.Error(logger).Log("msg", "Could not compile into regular expression", "regexp", m.Regexp, "err", err)
+					return false
+				}
+			}
+		}
+		var sendBytes []byte
+		if qr.SendBytes != "" {
+			if sendBytes, err = decodeBytes(qr.SendBytes, qr.BytesEncoding); err != nil {
+				level.Error(logger).Log("msg", "Could not decode bytes to send", "err", err)
+				return false
+			}
+		} else if send != "" {
+			sendBytes = []byte(send)
+			if !qr.NoTrailingNewline {
+				sendBytes = append(sendBytes, '\n')
+			}
 		}
-		if send != "" {
-			level.Debug(logger).Log("msg", "Sending line", "line", send)
-			if _, err := fmt.Fprintf(conn, "%s\n", send); err != nil {
+		if len(sendBytes) > 0 {
+			level.Debug(logger).Log("msg", "Sending line", "line", string(sendBytes))
+			if _, err := conn.Write(sendBytes); err != nil {
 				level.Error(logger).Log("msg", "Failed to send", "err", err)
 				return false
 			}
 		}
 		if qr.StartTLS {
 			// Upgrade TCP connection to TLS.
-			tlsConfig, err := pconfig.NewTLSConfig(&module.TCP.TLSConfig)
+			tlsConn, err := upgradeTLS(conn, target, module, durationGaugeVec)
 			if err != nil {
-				level.Error(logger).Log("msg", "Failed to create TLS configuration", "err", err)
-				return false
-			}
-			if tlsConfig.ServerName == "" {
-				// Use target-hostname as default for TLS-servername.
-				targetAddress, _, _ := net.SplitHostPort(target) // Had succeeded in dialTCP already.
-				tlsConfig.ServerName = targetAddress
-			}
-			tlsConn := tls.Client(conn, tlsConfig)
-			defer tlsConn.Close()
-
-			// Initiate TLS handshake (required here to get TLS state).
-			if err := tlsConn.Handshake(); err != nil {
 				level.Error(logger).Log("msg", "TLS Handshake (client) failed", "err", err)
+				recordFailure(ctx, FailureTLSHandshake)
 				return false
 			}
+			defer tlsConn.Close()
 			level.Info(logger).Log("msg", "TLS Handshake (client) succeeded.")
 			conn = net.Conn(tlsConn)
-			scanner = bufio.NewScanner(conn)
-
-			// Get certificate expiry.
-			state := tlsConn.ConnectionState()
-			registry.MustRegister(probeSSLEarliestCertExpiry, probeSSLLastChainExpiryTimestampSeconds)
-			probeSSLEarliestCertExpiry.Set(float64(getEarliestCertExpiry(&state).Unix()))
-			probeTLSVersion.WithLabelValues(getTLSVersion(&state)).Set(1)
-			probeSSLLastChainExpiryTimestampSeconds.Set(float64(getLastChainExpiry(&state).Unix()))
-			probeSSLLastInformation.WithLabelValues(getFingerprint(&state)).Set(1)
+			reader = bufio.NewReader(conn)
+			setTLSMetrics(tlsConn.ConnectionState())
 		}
+		endStep()
 	}
 	return true
 }
+
+// upgradeTLS performs a client TLS handshake over an established connection.
+func upgradeTLS(conn net.Conn, target string, module config.Module, durationGaugeVec *prometheus.GaugeVec) (*tls.Conn, error) {
+	tlsConfig, err := pconfig.NewTLSConfig(&module.TCP.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS configuration: %s", err)
+	}
+	if _, _, isUnix := splitUnixTarget(target); isUnix && tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		return nil, errUnixTLSServerName
+	}
+	if tlsConfig.ServerName == "" {
+		// Use target-hostname as default for TLS-servername.
+		targetAddress, _, _ := net.SplitHostPort(target) // Had succeeded in dialTCP already.
+		tlsConfig.ServerName = targetAddress
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	// Initiate TLS handshake (required here to get TLS state).
+	tlsStart := time.Now()
+	err = tlsConn.Handshake()
+	durationGaugeVec.WithLabelValues("tls").Add(time.Since(tlsStart).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// readFrame reads the next chunk of a response: ReadBytes bytes if set, or
+// up to the delimiter otherwise, which is not included. With the default
+// newline delimiter, a preceding carriage return is dropped too. A final
+// chunk without delimiter is returned as is.
+func readFrame(r *bufio.Reader, qr config.QueryResponse) ([]byte, error) {
+	if qr.ReadBytes > 0 {
+		frame := make([]byte, qr.ReadBytes)
+		n, err := io.ReadFull(r, frame)
+		return frame[:n], err
+	}
+	delim := []byte(qr.Delimiter)
+	if len(delim) == 0 {
+		delim = []byte("\n")
+	}
+	var frame []byte
+	for {
+		b, err := r.ReadBytes(delim[len(delim)-1])
+		frame = append(frame, b...)
+		if err != nil {
+			if err == io.EOF && len(frame) > 0 {
+				return frame, nil
+			}
+			return frame, err
+		}
+		if bytes.HasSuffix(frame, delim) {
+			frame = frame[:len(frame)-len(delim)]
+			break
+		}
+	}
+	if qr.Delimiter == "" {
+		frame = bytes.TrimSuffix(frame, []byte("\r"))
+	}
+	return frame, nil
+}
@@ -14,6 +14,7 @@
 package prober
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
@@ -22,10 +23,13 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -62,6 +66,50 @@ func TestTCPConnection(t *testing.T) {
 	<-ch
 }
 
+func TestTCPConnectionUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "probe.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "ready\n")
+	}()
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocolFallback: true,
+			QueryResponse:      []config.QueryResponse{{Expect: "^ready$"}},
+		},
+	}
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	if !ProbeTCP(testCTX, "unix://"+socketPath, module, registry, log.NewNopLogger()) {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+
+	// There is no host name to verify the certificate against.
+	module.TCP.TLS = true
+	durationGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "probe_tcp_duration_seconds"}, []string{"phase"})
+	if _, err := dialTCP(testCTX, "unix://"+socketPath, module, prometheus.NewRegistry(), durationGaugeVec, log.NewNopLogger()); err != errUnixTLSServerName {
+		t.Fatalf("Expected %q for TLS without server_name, got %v", errUnixTLSServerName, err)
+	}
+
+	// There are no IP addresses to announce.
+	module.TCP.TLS = false
+	module.ProxyProtocol = config.ProxyProtocol{Version: 1}
+	if _, err := dialTCP(testCTX, "unix://"+socketPath, module, prometheus.NewRegistry(), durationGaugeVec, log.NewNopLogger()); err != errUnixProxyProtocolAddresses {
+		t.Fatalf("Expected %q for PROXY protocol without addresses, got %v", errUnixProxyProtocolAddresses, err)
+	}
+}
+
 func TestTCPConnectionFails(t *testing.T) {
 	// Invalid port number.
 	registry := prometheus.NewRegistry()
@@ -564,6 +612,157 @@ func TestTCPConnectionQueryResponseMatching(t *testing.T) {
 
 }
 
+func TestTCPConnectionQueryResponseBinary(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocolFallback: true,
+			QueryResponse: []config.QueryResponse{
+				{
+					SendBytes: "00010203",
+				},
+				{
+					// A fixed size header carrying the version.
+					ExpectBytes: "cafe",
+					ReadBytes:   4,
+				},
+				{
+					// Captures work on binary data too.
+					Expect:            "\\x00(\\w+)\\x00",
+					Delimiter:         "\r\n\r\n",
+					Send:              "${1}",
+					NoTrailingNewline: true,
+				},
+			},
+		},
+	}
+
+	ch := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		conn.SetDeadline(time.Now().Add(1 * time.Second))
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil || !bytes.Equal(request, []byte{0, 1, 2, 3}) {
+			conn.Close()
+			ch <- nil
+			return
+		}
+		conn.Write([]byte{0xca, 0xfe, 0x00, 0x02})
+		conn.Write([]byte("\x00ignored\r\n\r\n\x00hello\x00\n\r\n\r\n"))
+		// Without trailing newline, the connection is closed right after.
+		got, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		ch <- got
+	}()
+	registry := prometheus.NewRegistry()
+	if !ProbeTCP(testCTX, ln.Addr().String(), module, registry, log.NewNopLogger()) {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	if got, want := <-ch, []byte("hello"); !bytes.Equal(got, want) {
+		t.Fatalf("Read unexpected data: got %q, want %q", got, want)
+	}
+}
+
+func TestTCPConnectionQueryResponseStepTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	testCTX, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	module := config.Module{
+		TCP: config.TCPProbe{
+			IPProtocolFallback: true,
+			QueryResponse: []config.QueryResponse{
+				{Expect: "^hello", Send: "ping"},
+				{Expect: "^pong", Timeout: 100 * time.Millisecond},
+			},
+		},
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "hello\n")
+		// Never answer the ping.
+		ioutil.ReadAll(conn)
+	}()
+	registry := prometheus.NewRegistry()
+	start := time.Now()
+	if ProbeTCP(testCTX, ln.Addr().String(), module, registry, log.NewNopLogger()) {
+		t.Fatalf("TCP module succeeded, expected failure.")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the step timeout to end the probe")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMetrics := map[string]map[string]map[string]struct{}{
+		"probe_tcp_step_duration_seconds": {
+			"step": {"0": {}, "1": {}},
+		},
+		"probe_tcp_duration_seconds": {
+			"phase": {"resolve": {}, "connect": {}, "tls": {}},
+		},
+	}
+	checkMetrics(expectedMetrics, mfs, t)
+	for _, mf := range mfs {
+		if mf.GetName() != "probe_tcp_step_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == "1" && m.GetGauge().GetValue() < 0.1 {
+				t.Fatalf("Expected step 1 to last at least its timeout, got %v", m.GetGauge().GetValue())
+			}
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		QR       config.QueryResponse
+		Input    string
+		Expected []string
+	}{
+		{config.QueryResponse{}, "a\r\nb\nc", []string{"a", "b", "c"}},
+		{config.QueryResponse{Delimiter: "||"}, "a|b||c||", []string{"a|b", "c"}},
+		{config.QueryResponse{ReadBytes: 2}, "abcde", []string{"ab", "cd"}},
+	}
+	for i, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.Input))
+		for _, expected := range test.Expected {
+			frame, err := readFrame(r, test.QR)
+			if err != nil {
+				t.Fatalf("Test %d: %s", i, err)
+			}
+			if string(frame) != expected {
+				t.Fatalf("Test %d: expected %q, got %q", i, expected, frame)
+			}
+		}
+		if _, err := readFrame(r, test.QR); err == nil {
+			t.Fatalf("Test %d: expected error at end of input", i)
+		}
+	}
+}
+
 func TestTCPConnectionProtocol(t *testing.T) {
 	// This test assumes that listening TCP listens both IPv6 and IPv4 traffic and
 	// localhost resolves to both 127.0.0.1 and ::1. we must skip the test if either
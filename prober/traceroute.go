@@ -0,0 +1,370 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// tracerouteHop holds the responses to the probes sent with a given TTL.
+type tracerouteHop struct {
+	ttl int
+	// addr is the address of the first responder, or nil if there was none.
+	addr    net.IP
+	sent    int
+	rtts    []time.Duration
+	reached bool
+}
+
+// tracerouteResponse is the response to a single probe.
+type tracerouteResponse struct {
+	peer    net.IP
+	rtt     time.Duration
+	reached bool
+}
+
+// tracerouteSender sends a single probe with the given TTL and waits for
+// the response. It returns nil if there was no response before ctx is done.
+type tracerouteSender func(ctx context.Context, ttl int) (*tracerouteResponse, error)
+
+func ProbeTraceroute(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	var (
+		hopCountGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_traceroute_hop_count",
+			Help: "Number of hops to the target, 0 if it was not reached",
+		})
+
+		pathHashGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_traceroute_path_hash",
+			Help: "Hash of the addresses of the hops on the path, changes when the route does",
+		})
+
+		hopRTTGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_traceroute_hop_rtt_seconds",
+			Help: "Average round trip time of the responses from a hop",
+		}, []string{"hop", "address"})
+
+		hopLossGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_traceroute_hop_packet_loss_ratio",
+			Help: "Ratio of the probes sent to a hop that did not get a response",
+		}, []string{"hop", "address"})
+	)
+
+	registry.MustRegister(hopCountGauge, pathHashGauge, hopRTTGaugeVec, hopLossGaugeVec)
+
+	tr := module.Traceroute
+	dstIPAddr, _, err := chooseProtocol(ctx, module.Resolver, tr.IPProtocol, tr.IPProtocolFallback, target, registry, logger)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error resolving address", "err", err)
+		return false
+	}
+
+	var srcIP net.IP
+	if len(tr.SourceIPAddress) > 0 {
+		if srcIP = net.ParseIP(tr.SourceIPAddress); srcIP == nil {
+			level.Error(logger).Log("msg", "Error parsing source ip address", "srcIP", tr.SourceIPAddress)
+			return false
+		}
+		level.Info(logger).Log("msg", "Using source address", "srcIP", srcIP)
+	}
+
+	// The TTL of IPv4 echo requests is set in the IP header written by us,
+	// and only privileged sockets see the errors about UDP and TCP probes.
+	isIPv6 := dstIPAddr.IP.To4() == nil
+	listenerKey := icmpListenerKey{raw: true, srcIP: "0.0.0.0"}
+	if isIPv6 {
+		listenerKey = icmpListenerKey{ipv6: true, privileged: true, srcIP: "::"}
+	}
+	if srcIP != nil {
+		listenerKey.srcIP = srcIP.String()
+	}
+	listenerKey.iface = tr.SourceInterface
+	listener, err := getICMPListener(listenerKey, logger)
+	if err != nil {
+		return false
+	}
+
+	var send tracerouteSender
+	switch tr.Protocol {
+	case "udp":
+		port := tr.Port
+		if port == 0 {
+			port = 33434
+		}
+		send = tracerouteUDP(listener, dstIPAddr, srcIP, port)
+	case "tcp":
+		port := tr.Port
+		if port == 0 {
+			port = 80
+		}
+		send = tracerouteTCP(listener, dstIPAddr, srcIP, port)
+	default:
+		send = tracerouteICMP(listener, dstIPAddr)
+	}
+
+	firstHop := tr.FirstHop
+	if firstHop == 0 {
+		firstHop = 1
+	}
+	maxHops := tr.MaxHops
+	if maxHops == 0 {
+		maxHops = 30
+	}
+	packetsPerHop := tr.PacketsPerHop
+	if packetsPerHop == 0 {
+		packetsPerHop = 3
+	}
+	hopTimeout := tr.HopTimeout
+	if hopTimeout == 0 {
+		hopTimeout = time.Second
+	}
+
+	var hops []tracerouteHop
+	for ttl := firstHop; ttl <= maxHops && ctx.Err() == nil; ttl++ {
+		hop := traceHop(ctx, send, ttl, packetsPerHop, hopTimeout, logger)
+		hops = append(hops, hop)
+		if hop.reached {
+			hopCountGauge.Set(float64(ttl))
+			break
+		}
+	}
+
+	pathHashGauge.Set(float64(traceroutePathHash(hops)))
+	for _, hop := range hops {
+		hopLabel := strconv.Itoa(hop.ttl)
+		address := ""
+		if hop.addr != nil {
+			address = hop.addr.String()
+		}
+		hopLossGaugeVec.WithLabelValues(hopLabel, address).Set(float64(hop.sent-len(hop.rtts)) / float64(hop.sent))
+		if len(hop.rtts) > 0 {
+			hopRTTGaugeVec.WithLabelValues(hopLabel, address).Set(icmpRTTStats(hop.rtts).avg.Seconds())
+		}
+	}
+
+	if len(hops) == 0 || !hops[len(hops)-1].reached {
+		level.Error(logger).Log("msg", "Target was not reached", "hops", len(hops))
+		return false
+	}
+	return true
+}
+
+// traceHop sends count probes with the given TTL at once and collects the
+// responses until all of them arrived or timeout has passed.
+func traceHop(ctx context.Context, send tracerouteSender, ttl, count int, timeout time.Duration, logger log.Logger) tracerouteHop {
+	hopCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	responses := make(chan *tracerouteResponse, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			response, err := send(hopCtx, ttl)
+			if err != nil {
+				level.Warn(logger).Log("msg", "Error sending probe", "ttl", ttl, "err", err)
+			}
+			responses <- response
+		}()
+	}
+
+	hop := tracerouteHop{ttl: ttl, sent: count}
+	for i := 0; i < count; i++ {
+		response := <-responses
+		if response == nil {
+			continue
+		}
+		if hop.addr == nil {
+			hop.addr = response.peer
+		}
+		hop.rtts = append(hop.rtts, response.rtt)
+		hop.reached = hop.reached || response.reached
+	}
+	level.Info(logger).Log("msg", "Probed hop", "ttl", ttl, "address", hop.addr, "responses", len(hop.rtts), "reached", hop.reached)
+	return hop
+}
+
+// traceroutePathHash hashes the addresses of the hops in order, with
+// unresponsive hops included as such. A 32 bit hash is used as it is
+// represented exactly by a float64.
+func traceroutePathHash(hops []tracerouteHop) uint32 {
+	addrs := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		if hop.addr == nil {
+			addrs = append(addrs, "*")
+		} else {
+			addrs = append(addrs, hop.addr.String())
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(addrs, ",")))
+	return h.Sum32()
+}
+
+// awaitTracerouteReply waits for an ICMP message about a probe sent at start.
+func awaitTracerouteReply(ctx context.Context, ch <-chan icmpReply, start time.Time, dst net.IP) *tracerouteResponse {
+	select {
+	case <-ctx.Done():
+		return nil
+	case reply := <-ch:
+		// Either an echo reply or an error such as port unreachable from
+		// the target itself, rather than a time exceeded from a router.
+		return &tracerouteResponse{peer: reply.peer, rtt: reply.received.Sub(start), reached: reply.peer.Equal(dst)}
+	}
+}
+
+func tracerouteICMP(listener *icmpListener, dst *net.IPAddr) tracerouteSender {
+	var requestType icmp.Type = ipv4.ICMPTypeEcho
+	if listener.key.ipv6 {
+		requestType = ipv6.ICMPTypeEchoRequest
+	}
+	return func(ctx context.Context, ttl int) (*tracerouteResponse, error) {
+		seq := int(getICMPSequence())
+		wm := icmp.Message{
+			Type: requestType,
+			Body: &icmp.Echo{ID: icmpID, Seq: seq, Data: []byte(icmpDefaultPayload)},
+		}
+		wb, err := wm.Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		ch := make(chan icmpReply, 1)
+		key := listener.waiterKey(dst.IP, icmpID, seq)
+		listener.register(key, ch)
+		defer listener.unregister(key)
+
+		start := time.Now()
+		if err := listener.writeTo(wb, dst, icmpWriteOptions{ttl: ttl}); err != nil {
+			return nil, err
+		}
+		return awaitTracerouteReply(ctx, ch, start, dst.IP), nil
+	}
+}
+
+func tracerouteUDP(listener *icmpListener, dst *net.IPAddr, srcIP net.IP, port int) tracerouteSender {
+	network := "udp4"
+	if listener.key.ipv6 {
+		network = "udp6"
+	}
+	return func(ctx context.Context, ttl int) (*tracerouteResponse, error) {
+		dialer := net.Dialer{}
+		if srcIP != nil {
+			dialer.LocalAddr = &net.UDPAddr{IP: srcIP}
+		}
+		if listener.key.iface != "" {
+			dialer.Control = bindToDeviceControl(listener.key.iface)
+		}
+		conn, err := dialer.DialContext(ctx, network, (&net.UDPAddr{IP: dst.IP, Zone: dst.Zone, Port: port}).String())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if listener.key.ipv6 {
+			err = ipv6.NewConn(conn).SetHopLimit(ttl)
+		} else {
+			err = ipv4.NewConn(conn).SetTTL(ttl)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ch := make(chan icmpReply, 1)
+		key := listener.transportWaiterKey(dst.IP, 17, conn.LocalAddr().(*net.UDPAddr).Port, port)
+		listener.register(key, ch)
+		defer listener.unregister(key)
+
+		start := time.Now()
+		if _, err := conn.Write([]byte(icmpDefaultPayload)); err != nil {
+			return nil, err
+		}
+		return awaitTracerouteReply(ctx, ch, start, dst.IP), nil
+	}
+}
+
+func tracerouteTCP(listener *icmpListener, dst *net.IPAddr, srcIP net.IP, port int) tracerouteSender {
+	network := "tcp4"
+	if listener.key.ipv6 {
+		network = "tcp6"
+	}
+	addr := (&net.TCPAddr{IP: dst.IP, Zone: dst.Zone, Port: port}).String()
+	return func(ctx context.Context, ttl int) (*tracerouteResponse, error) {
+		ch := make(chan icmpReply, 1)
+		dialed := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			var key *icmpWaiterKey
+			dialer := net.Dialer{Control: func(_, _ string, c syscall.RawConn) error {
+				if listener.key.iface != "" {
+					if err := bindToDevice(c, listener.key.iface); err != nil {
+						return err
+					}
+				}
+				// The local port must be known before the SYN is sent to
+				// match the errors about it.
+				lport, err := setTTLAndBind(c, listener.key.ipv6, ttl, srcIP)
+				if err != nil {
+					return err
+				}
+				k := listener.transportWaiterKey(dst.IP, 6, lport, port)
+				listener.register(k, ch)
+				key = &k
+				return nil
+			}}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if key != nil {
+				listener.unregister(*key)
+			}
+			if err == nil {
+				conn.Close()
+			}
+			dialed <- err
+		}()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case reply := <-ch:
+			return &tracerouteResponse{peer: reply.peer, rtt: reply.received.Sub(start), reached: reply.peer.Equal(dst.IP)}, nil
+		case err := <-dialed:
+			// A SYN-ACK or a RST both mean the target was reached.
+			if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+				return &tracerouteResponse{peer: dst.IP, rtt: time.Since(start), reached: true}, nil
+			}
+			select {
+			case reply := <-ch:
+				// The connection was aborted by an ICMP error.
+				return &tracerouteResponse{peer: reply.peer, rtt: reply.received.Sub(start), reached: reply.peer.Equal(dst.IP)}, nil
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/ipv4"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func TestTracerouteLoopback(t *testing.T) {
+	if c, err := net.ListenPacket("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Skip("Raw ICMP sockets are not available")
+	} else {
+		c.Close()
+	}
+
+	// The TCP probes are answered by this listener, the UDP ones by a port
+	// unreachable error as nothing listens on the port of the closed socket.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.Close()
+
+	tests := []config.TracerouteProbe{
+		{Protocol: "icmp"},
+		{Protocol: "udp", Port: udpConn.LocalAddr().(*net.UDPAddr).Port},
+		{Protocol: "tcp", Port: ln.Addr().(*net.TCPAddr).Port},
+	}
+	for _, tr := range tests {
+		tr.IPProtocol = "ip4"
+		registry := prometheus.NewRegistry()
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !ProbeTraceroute(testCTX, "127.0.0.1", config.Module{Traceroute: tr}, registry, log.NewNopLogger()) {
+			t.Fatalf("%s traceroute failed, expected success.", tr.Protocol)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedResults := map[string]float64{
+			"probe_traceroute_hop_count":             1,
+			"probe_traceroute_path_hash":             float64(traceroutePathHash([]tracerouteHop{{addr: net.ParseIP("127.0.0.1")}})),
+			"probe_traceroute_hop_packet_loss_ratio": 0,
+		}
+		checkRegistryResults(expectedResults, mfs, t)
+		expectedMetrics := map[string]map[string]map[string]struct{}{
+			"probe_traceroute_hop_rtt_seconds": {
+				"hop":     {"1": {}},
+				"address": {"127.0.0.1": {}},
+			},
+		}
+		checkMetrics(expectedMetrics, mfs, t)
+	}
+}
+
+func TestTraceroutePathHash(t *testing.T) {
+	a := []tracerouteHop{{addr: net.ParseIP("192.0.2.1")}, {}, {addr: net.ParseIP("192.0.2.3")}}
+	b := []tracerouteHop{{addr: net.ParseIP("192.0.2.1")}, {addr: net.ParseIP("192.0.2.2")}, {addr: net.ParseIP("192.0.2.3")}}
+	if traceroutePathHash(a) == traceroutePathHash(b) {
+		t.Fatalf("Expected paths with different hops to hash differently")
+	}
+	if traceroutePathHash(a) != traceroutePathHash(append([]tracerouteHop(nil), a...)) {
+		t.Fatalf("Expected equal paths to hash equally")
+	}
+}
+
+func TestTracerouteErrorDispatch(t *testing.T) {
+	l := &icmpListener{
+		privileged: true,
+		waiters:    map[icmpWaiterKey]chan<- icmpReply{},
+	}
+	dst := net.ParseIP("192.0.2.1").To4()
+	router := net.ParseIP("198.51.100.1")
+
+	// A time exceeded error quoting a UDP packet from port 40000 to 33434.
+	quote := make([]byte, ipv4.HeaderLen, ipv4.HeaderLen+8)
+	quote[0] = 0x45
+	quote[9] = 17
+	copy(quote[16:20], dst)
+	quote = append(quote, 0x9c, 0x40, 0x82, 0x9a, 0, 8, 0, 0)
+	msg := append([]byte{11, 0, 0, 0, 0, 0, 0, 0}, quote...)
+
+	orphaned := counterValue(t, icmpRepliesOrphaned)
+	ch := make(chan icmpReply, 1)
+	l.register(l.transportWaiterKey(dst, 17, 40000, 33434), ch)
+	l.dispatch(icmpReply{peer: router, data: msg})
+	select {
+	case reply := <-ch:
+		if !reply.peer.Equal(router) {
+			t.Fatalf("Expected error from %s, got %s", router, reply.peer)
+		}
+	default:
+		t.Fatalf("Expected error to be dispatched")
+	}
+
+	// Errors about packets of other processes are ignored.
+	l.unregister(l.transportWaiterKey(dst, 17, 40000, 33434))
+	l.dispatch(icmpReply{peer: router, data: msg})
+	if o := counterValue(t, icmpRepliesOrphaned) - orphaned; o != 0 {
+		t.Fatalf("Expected no orphaned replies, got %v", o)
+	}
+}
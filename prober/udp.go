@@ -0,0 +1,194 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+func dialUDP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) (net.Conn, error) {
+	var dialProtocol string
+	dialer := &net.Dialer{}
+	targetAddress, port, err := net.SplitHostPort(target)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error splitting target address and port", "err", err)
+		return nil, err
+	}
+
+	ip, _, err := chooseProtocol(ctx, module.Resolver, module.UDP.IPProtocol, module.UDP.IPProtocolFallback, targetAddress, registry, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error resolving address", "err", err)
+		return nil, err
+	}
+
+	if ip.IP.To4() == nil {
+		dialProtocol = "udp6"
+	} else {
+		dialProtocol = "udp4"
+	}
+
+	if len(module.UDP.SourceIPAddress) > 0 {
+		srcIP := net.ParseIP(module.UDP.SourceIPAddress)
+		if srcIP == nil {
+			level.Error(logger).Log("msg", "Error parsing source ip address", "srcIP", module.UDP.SourceIPAddress)
+			return nil, fmt.Errorf("error parsing source ip address: %s", module.UDP.SourceIPAddress)
+		}
+		level.Info(logger).Log("msg", "Using local address", "srcIP", srcIP)
+		dialer.LocalAddr = &net.UDPAddr{IP: srcIP}
+	}
+	if len(module.UDP.SourceInterface) > 0 {
+		level.Info(logger).Log("msg", "Using source interface", "interface", module.UDP.SourceInterface)
+		dialer.Control = bindToDeviceControl(module.UDP.SourceInterface)
+	}
+
+	// A connected socket receives ICMP port unreachable errors as
+	// ECONNREFUSED on the following reads and writes.
+	return dialer.DialContext(ctx, dialProtocol, net.JoinHostPort(ip.String(), port))
+}
+
+func ProbeUDP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	probeRTT := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_udp_rtt_seconds",
+		Help: "Time from the last datagram sent to the expected response, by query_response step",
+	}, []string{"step"})
+	probePortUnreachable := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_udp_port_unreachable",
+		Help: "Indicates if an ICMP port unreachable error was received",
+	})
+	probeFailedDueToRegex := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_failed_due_to_regex",
+		Help: "Indicates if probe failed due to regex",
+	})
+	registry.MustRegister(probeRTT, probePortUnreachable, probeFailedDueToRegex)
+	deadline, _ := ctx.Deadline()
+
+	conn, err := dialUDP(ctx, target, module, registry, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error dialing UDP", "err", err)
+		return false
+	}
+	defer conn.Close()
+
+	// checkErr records port unreachable errors before logging err.
+	checkErr := func(msg string, err error) {
+		recordError(ctx, err)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			probePortUnreachable.Set(1)
+			level.Error(logger).Log("msg", "Port unreachable", "err", err)
+			return
+		}
+		level.Error(logger).Log("msg", msg, "err", err)
+	}
+
+	lastSend := time.Now()
+	rb := make([]byte, 65536)
+	for i, qr := range module.UDP.QueryResponse {
+		level.Info(logger).Log("msg", "Processing query response entry", "entry_number", i)
+		send, err := decodeBytes(qr.SendBytes, qr.BytesEncoding)
+		if err != nil {
+			level.Error(logger).Log("msg", "Could not decode bytes to send", "err", err)
+			return false
+		}
+		if qr.Expect != "" || qr.ExpectBytes != "" {
+			var re *regexp.Regexp
+			if qr.Expect != "" {
+				if re, err = regexp.Compile(qr.Expect); err != nil {
+					level.Error(logger).Log("msg", "Could not compile into regular expression", "regexp", qr.Expect, "err", err)
+					return false
+				}
+			}
+			expectBytes, err := decodeBytes(qr.ExpectBytes, qr.BytesEncoding)
+			if err != nil {
+				level.Error(logger).Log("msg", "Could not decode expected bytes", "err", err)
+				return false
+			}
+
+			readDeadline := deadline
+			if module.UDP.ReadTimeout > 0 && time.Now().Add(module.UDP.ReadTimeout).Before(deadline) {
+				readDeadline = time.Now().Add(module.UDP.ReadTimeout)
+			}
+			if err := conn.SetReadDeadline(readDeadline); err != nil {
+				level.Error(logger).Log("msg", "Error setting deadline", "err", err)
+				return false
+			}
+
+			// Read datagrams until one of them matches.
+			var (
+				datagram []byte
+				match    []int
+				read     bool
+			)
+			for {
+				n, err := conn.Read(rb)
+				if err != nil {
+					if read {
+						probeFailedDueToRegex.Set(1)
+						level.Error(logger).Log("msg", "No datagram matched", "regexp", re, "expect_bytes", qr.ExpectBytes)
+					}
+					checkErr("Error reading from connection", err)
+					return false
+				}
+				read = true
+				datagram = rb[:n]
+				level.Debug(logger).Log("msg", "Read datagram", "datagram", hex.EncodeToString(datagram))
+				if expectBytes != nil && !bytes.Contains(datagram, expectBytes) {
+					continue
+				}
+				if re != nil {
+					if match = re.FindSubmatchIndex(datagram); match == nil {
+						continue
+					}
+				}
+				break
+			}
+			probeFailedDueToRegex.Set(0)
+			probeRTT.WithLabelValues(strconv.Itoa(i)).Set(time.Since(lastSend).Seconds())
+			level.Info(logger).Log("msg", "Datagram matched", "regexp", re, "expect_bytes", qr.ExpectBytes)
+			if qr.Send != "" && match != nil {
+				send = re.Expand(nil, []byte(qr.Send), datagram, match)
+			}
+		}
+		if send == nil && qr.Send != "" {
+			send = []byte(qr.Send)
+		}
+		if send != nil {
+			level.Debug(logger).Log("msg", "Sending datagram", "datagram", hex.EncodeToString(send))
+			if err := conn.SetWriteDeadline(deadline); err != nil {
+				level.Error(logger).Log("msg", "Error setting deadline", "err", err)
+				return false
+			}
+			if _, err := conn.Write(send); err != nil {
+				checkErr("Failed to send", err)
+				return false
+			}
+			lastSend = time.Now()
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// udpEchoServer answers "ping <word>" with a datagram containing a binary
+// header and "pong <word>", after sending an unrelated datagram first.
+func udpEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !bytes.HasPrefix(buf[:n], []byte("ping ")) {
+				continue
+			}
+			conn.WriteTo([]byte("noise"), addr)
+			conn.WriteTo(append([]byte{0xca, 0xfe, 'p', 'o', 'n', 'g', ' '}, buf[5:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPQueryResponse(t *testing.T) {
+	server := udpEchoServer(t)
+	defer server.Close()
+
+	module := config.Module{UDP: config.UDPProbe{
+		IPProtocol: "ip4",
+		QueryResponse: []config.UDPQueryResponse{
+			{Send: "ping blackbox"},
+			{ExpectBytes: "cafe", Expect: "pong (\\w+)", Send: "ping ${1}-again"},
+			{ExpectBytes: "cafe", Expect: "pong blackbox-again"},
+		},
+	}}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !ProbeUDP(testCTX, server.LocalAddr().String(), module, registry, log.NewNopLogger()) {
+		t.Fatalf("UDP module failed, expected success.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResults := map[string]float64{
+		"probe_udp_port_unreachable": 0,
+		"probe_failed_due_to_regex":  0,
+	}
+	checkRegistryResults(expectedResults, mfs, t)
+	expectedMetrics := map[string]map[string]map[string]struct{}{
+		"probe_udp_rtt_seconds": {
+			"step": {"1": {}, "2": {}},
+		},
+	}
+	checkMetrics(expectedMetrics, mfs, t)
+}
+
+func TestUDPReadTimeout(t *testing.T) {
+	server := udpEchoServer(t)
+	defer server.Close()
+
+	module := config.Module{UDP: config.UDPProbe{
+		IPProtocol:  "ip4",
+		ReadTimeout: 100 * time.Millisecond,
+		QueryResponse: []config.UDPQueryResponse{
+			{SendBytes: "cGluZyBibGFja2JveA==", BytesEncoding: "base64"},
+			{Expect: "never"},
+		},
+	}}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if ProbeUDP(testCTX, server.LocalAddr().String(), module, registry, log.NewNopLogger()) {
+		t.Fatalf("UDP module succeeded, expected failure.")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the read timeout to end the probe")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRegistryResults(map[string]float64{"probe_failed_due_to_regex": 1}, mfs, t)
+}
+
+func TestUDPPortUnreachable(t *testing.T) {
+	// Nothing listens on the port once the socket is closed.
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	conn.Close()
+
+	module := config.Module{UDP: config.UDPProbe{
+		IPProtocol: "ip4",
+		QueryResponse: []config.UDPQueryResponse{
+			{Send: "ping"},
+			{Expect: "pong"},
+		},
+	}}
+	registry := prometheus.NewRegistry()
+	testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if ProbeUDP(testCTX, conn.LocalAddr().String(), module, registry, log.NewNopLogger()) {
+		t.Fatalf("UDP module succeeded, expected failure.")
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRegistryResults(map[string]float64{"probe_udp_port_unreachable": 1}, mfs, t)
+}
@@ -15,19 +15,92 @@ package prober
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"hash/fnv"
 	"net"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 
 	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
 )
 
+// lookupIPAddr resolves host, using the overrides and DNS server of the
+// resolver configuration if set.
+func lookupIPAddr(ctx context.Context, rc config.Resolver, host string) ([]net.IPAddr, error) {
+	if addrs, ok := rc.Overrides[host]; ok {
+		ips := make([]net.IPAddr, 0, len(addrs))
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("resolver override address '%s' is not valid", addr)
+			}
+			ips = append(ips, net.IPAddr{IP: ip})
+		}
+		return ips, nil
+	}
+	return newResolver(rc).LookupIPAddr(ctx, host)
+}
+
+// newResolver returns a resolver querying the DNS server of the resolver
+// configuration, over TLS if set, or the system resolver.
+func newResolver(rc config.Resolver) *net.Resolver {
+	if rc.Server == "" {
+		return &net.Resolver{}
+	}
+	server := rc.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		port := "53"
+		if rc.DNSOverTLS {
+			port = "853"
+		}
+		server = net.JoinHostPort(server, port)
+	}
+	return &net.Resolver{
+		// The resolver of cgo does not support custom servers.
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{}
+			if !rc.DNSOverTLS {
+				return dialer.DialContext(ctx, network, server)
+			}
+			tlsConfig, err := pconfig.NewTLSConfig(&rc.TLSConfig)
+			if err != nil {
+				return nil, err
+			}
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName, _, _ = net.SplitHostPort(server)
+			}
+			// Queries are sent over TCP, as the connection is not a
+			// net.PacketConn.
+			conn, err := dialer.DialContext(ctx, "tcp", server)
+			if err != nil {
+				return nil, err
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
 // Returns the IP for the IPProtocol and lookup time.
-func chooseProtocol(ctx context.Context, IPProtocol string, fallbackIPProtocol bool, target string, registry *prometheus.Registry, logger log.Logger) (ip *net.IPAddr, lookupTime float64, err error) {
+func chooseProtocol(ctx context.Context, rc config.Resolver, IPProtocol string, fallbackIPProtocol bool, target string, registry *prometheus.Registry, logger log.Logger) (ip *net.IPAddr, lookupTime float64, err error) {
 	var fallbackProtocol string
 	probeDNSLookupTimeSeconds := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "probe_dns_lookup_time_seconds",
@@ -63,8 +136,7 @@ func chooseProtocol(ctx context.Context, IPProtocol string, fallbackIPProtocol b
 		probeDNSLookupTimeSeconds.Add(lookupTime)
 	}()
 
-	resolver := &net.Resolver{}
-	ips, err := resolver.LookupIPAddr(ctx, target)
+	ips, err := lookupIPAddr(ctx, rc, target)
 	if err != nil {
 		level.Error(logger).Log("msg", "Resolution with IP protocol failed", "err", err)
 		return nil, 0.0, err
@@ -119,3 +191,44 @@ func ipHash(ip net.IP) float64 {
 	h.Write(ip)
 	return float64(h.Sum32())
 }
+
+// bindToDeviceControl returns a Control function for net.Dialer and
+// net.ListenConfig binding sockets to the network interface iface.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		if err := bindToDevice(c, iface); err != nil {
+			return fmt.Errorf("error binding to interface %s: %s", iface, err)
+		}
+		return nil
+	}
+}
+
+// splitUnixTarget splits a target like unix:///run/app.sock:/path into the
+// path of the socket and the rest of the target. ok is false if the target is
+// not a Unix domain socket.
+func splitUnixTarget(target string) (socketPath, rest string, ok bool) {
+	if !strings.HasPrefix(target, "unix://") {
+		return "", "", false
+	}
+	socketPath = strings.TrimPrefix(target, "unix://")
+	if i := strings.Index(socketPath, ":/"); i >= 0 {
+		socketPath, rest = socketPath[:i], socketPath[i+1:]
+	}
+	return socketPath, rest, true
+}
+
+// decodeBytes decodes b in the given bytes encoding, hex by default. It
+// returns nil if b is empty.
+func decodeBytes(b, encoding string) ([]byte, error) {
+	if b == "" {
+		return nil, nil
+	}
+	switch encoding {
+	case "", "hex":
+		return hex.DecodeString(b)
+	case "base64":
+		return base64.StdEncoding.DecodeString(b)
+	default:
+		return nil, fmt.Errorf("bytes encoding '%s' is not valid", encoding)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -28,9 +29,12 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
-
+	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
 )
 
 // Check if expected results are in the registry
@@ -151,7 +155,7 @@ func TestChooseProtocol(t *testing.T) {
 	w := log.NewSyncWriter(os.Stderr)
 	logger := log.NewLogfmtLogger(w)
 
-	ip, _, err := chooseProtocol(ctx, "ip4", true, "ipv6.google.com", registry, logger)
+	ip, _, err := chooseProtocol(ctx, config.Resolver{}, "ip4", true, "ipv6.google.com", registry, logger)
 	if err != nil {
 		t.Error(err)
 	}
@@ -161,7 +165,7 @@ func TestChooseProtocol(t *testing.T) {
 
 	registry = prometheus.NewPedanticRegistry()
 
-	ip, _, err = chooseProtocol(ctx, "ip4", false, "ipv6.google.com", registry, logger)
+	ip, _, err = chooseProtocol(ctx, config.Resolver{}, "ip4", false, "ipv6.google.com", registry, logger)
 	if err != nil && err.Error() != "unable to find ip; no fallback" {
 		t.Error(err)
 	} else if err == nil {
@@ -172,6 +176,76 @@ func TestChooseProtocol(t *testing.T) {
 	}
 }
 
+func TestChooseProtocolResolver(t *testing.T) {
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "backend.example." {
+			a, _ := dns.NewRR("backend.example. 300 IN A 192.0.2.10")
+			m.Answer = append(m.Answer, a)
+		}
+		w.WriteMsg(m)
+	}
+	server, addr := startDNSServer("udp", handler)
+	defer server.Shutdown()
+	_, port, _ := net.SplitHostPort(addr.String())
+
+	certExpiry := time.Now().AddDate(0, 0, 1)
+	testCertTmpl := generateCertificateTemplate(certExpiry, true)
+	_, testCertPem, testKey := generateSelfSignedCertificate(testCertTmpl)
+	testKeyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKey)})
+	testCert, err := tls.X509KeyPair(testCertPem, testKeyPem)
+	if err != nil {
+		t.Fatalf("Failed to decode TLS testing keypair: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert}})
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", handler)
+	tlsServer := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: mux}
+	go tlsServer.ActivateAndServe()
+	defer tlsServer.Shutdown()
+
+	tests := []struct {
+		resolver config.Resolver
+		target   string
+		expected string
+	}{
+		{
+			resolver: config.Resolver{Overrides: map[string][]string{"backend.example": {"2001:db8::1", "192.0.2.1"}}},
+			target:   "backend.example",
+			expected: "192.0.2.1",
+		},
+		{
+			resolver: config.Resolver{Overrides: map[string][]string{"other.example": {"192.0.2.1"}}, Server: net.JoinHostPort("127.0.0.1", port)},
+			target:   "backend.example",
+			expected: "192.0.2.10",
+		},
+		{
+			resolver: config.Resolver{
+				Server:     ln.Addr().String(),
+				DNSOverTLS: true,
+				TLSConfig:  pconfig.TLSConfig{InsecureSkipVerify: true},
+			},
+			target:   "backend.example",
+			expected: "192.0.2.10",
+		},
+	}
+	for i, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		ip, _, err := chooseProtocol(ctx, test.resolver, "ip4", true, test.target, prometheus.NewRegistry(), log.NewNopLogger())
+		cancel()
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %s", i, err)
+		}
+		if ip.String() != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, ip)
+		}
+	}
+}
+
 func checkMetrics(expected map[string]map[string]map[string]struct{}, mfs []*dto.MetricFamily, t *testing.T) {
 	type (
 		valueValidation struct {
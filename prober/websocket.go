@@ -0,0 +1,502 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// websocketGUID is appended to the key of the handshake to compute
+// Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes, from RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsMaxMessageSize limits the size of the messages read.
+const wsMaxMessageSize = 16 << 20
+
+// websocketAccept returns the expected Sec-WebSocket-Accept for key.
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// writeWebSocketFrame writes a single masked frame, as clients must.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(n))
+		frame = append(append(frame, 0x80|126), length...)
+	default:
+		length := make([]byte, 8)
+		binary.BigEndian.PutUint64(length, uint64(n))
+		frame = append(append(frame, 0x80|127), length...)
+	}
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[start+i] ^= mask[i%4]
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+type websocketFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+func readWebSocketFrame(r io.Reader) (websocketFrame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return websocketFrame{}, err
+	}
+	f := websocketFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+	if length > wsMaxMessageSize {
+		return f, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	for i := range mask {
+		for j := i; j < len(f.payload); j += 4 {
+			f.payload[j] ^= mask[i]
+		}
+	}
+	return f, nil
+}
+
+// readWebSocketMessage returns the next data message or pong, answering
+// pings and close frames on the way.
+func readWebSocketMessage(rw io.ReadWriter, logger log.Logger) (byte, []byte, error) {
+	var (
+		opcode  byte
+		message []byte
+	)
+	for {
+		f, err := readWebSocketFrame(rw)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch f.opcode {
+		case wsPing:
+			level.Debug(logger).Log("msg", "Answering ping", "payload", hex.EncodeToString(f.payload))
+			if err := writeWebSocketFrame(rw, wsPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			return wsPong, f.payload, nil
+		case wsClose:
+			code := 0
+			if len(f.payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(f.payload))
+			}
+			writeWebSocketFrame(rw, wsClose, f.payload)
+			return 0, nil, fmt.Errorf("connection closed by server with code %d", code)
+		case wsText, wsBinary:
+			opcode, message = f.opcode, f.payload
+		case wsContinuation:
+			message = append(message, f.payload...)
+			if len(message) > wsMaxMessageSize {
+				return 0, nil, fmt.Errorf("message of %d bytes is too large", len(message))
+			}
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode %d", f.opcode)
+		}
+		if f.fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func ProbeWebSocket(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	var (
+		durationGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_websocket_duration_seconds",
+			Help: "Duration of the WebSocket handshake by phase",
+		}, []string{"phase"})
+		statusCodeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_websocket_status_code",
+			Help: "Response HTTP status code of the upgrade request",
+		})
+		handshakeValidGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_websocket_handshake_valid",
+			Help: "Indicates if the upgrade response had valid Upgrade and Sec-WebSocket-Accept headers",
+		})
+		messageRTTGaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_websocket_message_rtt_seconds",
+			Help: "Time from the last message sent to the expected message or pong, by query_response step",
+		}, []string{"step"})
+		probeFailedDueToRegex = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_failed_due_to_regex",
+			Help: "Indicates if probe failed due to regex",
+		})
+		probeSSLEarliestCertExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ssl_earliest_cert_expiry",
+			Help: "Returns earliest SSL cert expiry date",
+		})
+		probeSSLLastChainExpiryTimestampSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ssl_last_chain_expiry_timestamp_seconds",
+			Help: "Returns last SSL chain expiry in unixtime",
+		})
+		probeSSLLastInformation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_ssl_last_chain_info",
+			Help: "Contains SSL leaf certificate information",
+		}, []string{"fingerprint_sha256"})
+		probeTLSVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_tls_version_info",
+			Help: "Returns the TLS version used, or NaN when unknown",
+		}, []string{"version"})
+	)
+	for _, lv := range []string{"resolve", "connect", "tls", "upgrade"} {
+		durationGaugeVec.WithLabelValues(lv)
+	}
+	registry.MustRegister(durationGaugeVec, statusCodeGauge, handshakeValidGauge, messageRTTGaugeVec, probeFailedDueToRegex)
+
+	wsConfig := module.WebSocket
+	if !strings.Contains(target, "://") {
+		target = "ws://" + target
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		level.Error(logger).Log("msg", "Could not parse target URL", "err", err)
+		return false
+	}
+	switch targetURL.Scheme {
+	case "ws":
+		targetURL.Scheme = "http"
+	case "wss":
+		targetURL.Scheme = "https"
+	case "http", "https":
+	default:
+		level.Error(logger).Log("msg", "Unsupported URL scheme", "scheme", targetURL.Scheme)
+		return false
+	}
+
+	targetHost := targetURL.Hostname()
+	ip, lookupTime, err := chooseProtocol(ctx, module.Resolver, wsConfig.IPProtocol, wsConfig.IPProtocolFallback, targetHost, registry, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error resolving address", "err", err)
+		return false
+	}
+	durationGaugeVec.WithLabelValues("resolve").Add(lookupTime)
+
+	httpClientConfig := wsConfig.HTTPClientConfig
+	if len(httpClientConfig.TLSConfig.ServerName) == 0 {
+		httpClientConfig.TLSConfig.ServerName = targetHost
+	}
+	tlsConfig, err := pconfig.NewTLSConfig(&httpClientConfig.TLSConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating TLS configuration", "err", err)
+		return false
+	}
+
+	// Keep the connection to set deadlines once it was upgraded. HTTP/2 is
+	// not attempted, as the transport has its own dialer.
+	var conn net.Conn
+	dial := moduleDialContext(module, &net.Dialer{})
+	httpTransport := &http.Transport{
+		Proxy:             http.ProxyURL(httpClientConfig.ProxyURL.URL),
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, err := dial(ctx, network, address)
+			conn = c
+			return c, err
+		},
+	}
+	client := &http.Client{
+		Transport: authRoundTripper(httpClientConfig, httpTransport),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Replace the host field in the URL with the IP we resolved.
+	origHost := targetURL.Host
+	if targetURL.Port() == "" {
+		if strings.Contains(ip.String(), ":") {
+			targetURL.Host = "[" + ip.String() + "]"
+		} else {
+			targetURL.Host = ip.String()
+		}
+	} else {
+		targetURL.Host = net.JoinHostPort(ip.String(), targetURL.Port())
+	}
+
+	request, err := http.NewRequest("GET", targetURL.String(), nil)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating request", "err", err)
+		return false
+	}
+	request.Host = origHost
+	for key, value := range wsConfig.Headers {
+		if strings.Title(key) == "Host" {
+			request.Host = value
+			continue
+		}
+		request.Header.Set(key, value)
+	}
+	rawKey := make([]byte, 16)
+	if _, err := rand.Read(rawKey); err != nil {
+		level.Error(logger).Log("msg", "Error generating WebSocket key", "err", err)
+		return false
+	}
+	key := base64.StdEncoding.EncodeToString(rawKey)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	if len(wsConfig.Subprotocols) > 0 {
+		request.Header.Set("Sec-WebSocket-Protocol", strings.Join(wsConfig.Subprotocols, ", "))
+	}
+
+	var connectStart, connectDone, tlsStart, tlsDone, wroteRequest, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(_, _ string) { connectStart = time.Now() },
+		ConnectDone:          func(_, _ string, _ error) { connectDone = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { tlsDone = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	request = request.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	level.Info(logger).Log("msg", "Making WebSocket upgrade request", "url", targetURL.String(), "host", request.Host)
+	resp, err := client.Do(request)
+	if !connectDone.IsZero() {
+		durationGaugeVec.WithLabelValues("connect").Add(connectDone.Sub(connectStart).Seconds())
+	}
+	if !tlsDone.IsZero() {
+		durationGaugeVec.WithLabelValues("tls").Add(tlsDone.Sub(tlsStart).Seconds())
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "Error for upgrade request", "err", err)
+		recordError(ctx, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if !firstByte.IsZero() {
+		durationGaugeVec.WithLabelValues("upgrade").Add(firstByte.Sub(wroteRequest).Seconds())
+	}
+	statusCodeGauge.Set(float64(resp.StatusCode))
+	if resp.TLS != nil {
+		registry.MustRegister(probeSSLEarliestCertExpiry, probeTLSVersion, probeSSLLastChainExpiryTimestampSeconds, probeSSLLastInformation)
+		probeSSLEarliestCertExpiry.Set(float64(getEarliestCertExpiry(resp.TLS).Unix()))
+		probeTLSVersion.WithLabelValues(getTLSVersion(resp.TLS)).Set(1)
+		probeSSLLastChainExpiryTimestampSeconds.Set(float64(getLastChainExpiry(resp.TLS).Unix()))
+		probeSSLLastInformation.WithLabelValues(getFingerprint(resp.TLS)).Set(1)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		level.Error(logger).Log("msg", "Upgrade request was not accepted", "status_code", resp.StatusCode)
+		recordFailure(ctx, FailureStatus)
+		return false
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		level.Error(logger).Log("msg", "Invalid WebSocket handshake response", "upgrade", resp.Header.Get("Upgrade"), "accept", resp.Header.Get("Sec-WebSocket-Accept"))
+		return false
+	}
+	handshakeValidGauge.Set(1)
+	if subprotocol := resp.Header.Get("Sec-WebSocket-Protocol"); subprotocol != "" {
+		level.Info(logger).Log("msg", "Server selected subprotocol", "subprotocol", subprotocol)
+	}
+	rw, ok := resp.Body.(io.ReadWriter)
+	if !ok || conn == nil {
+		level.Error(logger).Log("msg", "Upgraded connection is not writable")
+		return false
+	}
+	level.Info(logger).Log("msg", "WebSocket handshake succeeded")
+
+	deadline, _ := ctx.Deadline()
+	lastSend := time.Now()
+	for i, qr := range wsConfig.QueryResponse {
+		level.Info(logger).Log("msg", "Processing query response entry", "entry_number", i)
+		stepDeadline := deadline
+		if qr.Timeout > 0 && time.Now().Add(qr.Timeout).Before(deadline) {
+			stepDeadline = time.Now().Add(qr.Timeout)
+		}
+		if err := conn.SetDeadline(stepDeadline); err != nil {
+			level.Error(logger).Log("msg", "Error setting deadline", "err", err)
+			return false
+		}
+
+		if qr.Ping {
+			payload := []byte(strconv.Itoa(i))
+			if err := writeWebSocketFrame(rw, wsPing, payload); err != nil {
+				level.Error(logger).Log("msg", "Failed to send ping", "err", err)
+				return false
+			}
+			pingSent := time.Now()
+			for {
+				opcode, message, err := readWebSocketMessage(rw, logger)
+				if err != nil {
+					level.Error(logger).Log("msg", "Error waiting for pong", "err", err)
+					recordError(ctx, err)
+					return false
+				}
+				if opcode == wsPong && bytes.Equal(message, payload) {
+					break
+				}
+			}
+			messageRTTGaugeVec.WithLabelValues(strconv.Itoa(i)).Set(time.Since(pingSent).Seconds())
+			level.Info(logger).Log("msg", "Received pong")
+			continue
+		}
+
+		send, err := decodeBytes(qr.SendBytes, qr.BytesEncoding)
+		if err != nil {
+			level.Error(logger).Log("msg", "Could not decode bytes to send", "err", err)
+			return false
+		}
+		if qr.Expect != "" || qr.ExpectBytes != "" {
+			var re *regexp.Regexp
+			if qr.Expect != "" {
+				if re, err = regexp.Compile(qr.Expect); err != nil {
+					level.Error(logger).Log("msg", "Could not compile into regular expression", "regexp", qr.Expect, "err", err)
+					return false
+				}
+			}
+			expectBytes, err := decodeBytes(qr.ExpectBytes, qr.BytesEncoding)
+			if err != nil {
+				level.Error(logger).Log("msg", "Could not decode expected bytes", "err", err)
+				return false
+			}
+
+			// Read messages until one of them matches.
+			var (
+				message []byte
+				match   []int
+				read    bool
+			)
+			for {
+				var opcode byte
+				opcode, message, err = readWebSocketMessage(rw, logger)
+				if err != nil {
+					if read {
+						probeFailedDueToRegex.Set(1)
+						level.Error(logger).Log("msg", "No message matched", "regexp", re, "expect_bytes", qr.ExpectBytes)
+					}
+					level.Error(logger).Log("msg", "Error reading message", "err", err)
+					recordError(ctx, err)
+					return false
+				}
+				if opcode == wsPong {
+					continue
+				}
+				read = true
+				level.Debug(logger).Log("msg", "Read message", "message", string(message))
+				if expectBytes != nil && !bytes.Contains(message, expectBytes) {
+					continue
+				}
+				if re != nil {
+					if match = re.FindSubmatchIndex(message); match == nil {
+						continue
+					}
+				}
+				break
+			}
+			probeFailedDueToRegex.Set(0)
+			messageRTTGaugeVec.WithLabelValues(strconv.Itoa(i)).Set(time.Since(lastSend).Seconds())
+			level.Info(logger).Log("msg", "Message matched", "regexp", re, "expect_bytes", qr.ExpectBytes)
+			if qr.Send != "" && match != nil {
+				send = re.Expand(nil, []byte(qr.Send), message, match)
+			}
+		}
+		opcode := byte(wsBinary)
+		if qr.SendBytes == "" {
+			opcode = wsText
+			if send == nil && qr.Send != "" {
+				send = []byte(qr.Send)
+			}
+		}
+		if send != nil {
+			level.Debug(logger).Log("msg", "Sending message", "message", string(send))
+			if err := writeWebSocketFrame(rw, opcode, send); err != nil {
+				level.Error(logger).Log("msg", "Failed to send", "err", err)
+				return false
+			}
+			lastSend = time.Now()
+		}
+	}
+
+	// Close the connection normally.
+	writeWebSocketFrame(rw, wsClose, []byte{0x03, 0xe8})
+	return true
+}
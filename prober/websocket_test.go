@@ -0,0 +1,176 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+
+	"github.com/prometheus/blackbox_exporter/config"
+)
+
+// websocketServerFrame returns an unmasked frame, as sent by servers.
+func websocketServerFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	return append([]byte{first, byte(len(payload))}, payload...)
+}
+
+// websocketEchoHandler greets the client in two fragments after checking that
+// it answers pings, then echoes every message it receives.
+func websocketEchoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "probe" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Error hijacking connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		accept := websocketAccept(r.Header.Get("Sec-WebSocket-Key"))
+		if r.URL.Path == "/bad-accept" {
+			accept = "invalid"
+		}
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+		brw.Write(websocketServerFrame(true, wsPing, "check"))
+		brw.Flush()
+		f, err := readWebSocketFrame(brw)
+		if err != nil || f.opcode != wsPong || string(f.payload) != "check" {
+			return
+		}
+		brw.Write(websocketServerFrame(false, wsText, "welcome "))
+		brw.Write(websocketServerFrame(true, wsContinuation, "alice"))
+		brw.Flush()
+		for {
+			f, err := readWebSocketFrame(brw)
+			if err != nil {
+				return
+			}
+			switch f.opcode {
+			case wsPing:
+				brw.Write(websocketServerFrame(true, wsPong, string(f.payload)))
+			case wsText:
+				brw.Write(websocketServerFrame(true, wsText, "echo: "+string(f.payload)))
+			case wsBinary:
+				brw.Write(websocketServerFrame(true, wsBinary, string(f.payload)))
+			case wsClose:
+				brw.Write(websocketServerFrame(true, wsClose, string(f.payload)))
+				brw.Flush()
+				return
+			}
+			brw.Flush()
+		}
+	})
+}
+
+func TestWebSocketFrameLengths(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte("x"), n)
+		var buf bytes.Buffer
+		if err := writeWebSocketFrame(&buf, 0x1, payload); err != nil {
+			t.Fatal(err)
+		}
+		f, err := readWebSocketFrame(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("Error reading frame of %d bytes: %s", n, err)
+		}
+		if !f.fin || f.opcode != 0x1 || !bytes.Equal(f.payload, payload) {
+			t.Errorf("Frame of %d bytes does not round trip, got %d bytes", n, len(f.payload))
+		}
+	}
+}
+
+func TestWebSocketQueryResponse(t *testing.T) {
+	ts := httptest.NewServer(websocketEchoHandler(t))
+	defer ts.Close()
+
+	script := []config.WebSocketQueryResponse{
+		{Expect: "^welcome (\\w+)$", Send: "hello ${1}"},
+		{Expect: "^echo: hello alice$"},
+		{Ping: true},
+		{SendBytes: "0001ff"},
+		{ExpectBytes: "0001ff"},
+	}
+	tests := []struct {
+		path          string
+		password      string
+		queryResponse []config.WebSocketQueryResponse
+		success       bool
+		results       map[string]float64
+	}{
+		{path: "/", password: "secret", queryResponse: script, success: true,
+			results: map[string]float64{"probe_websocket_status_code": 101, "probe_websocket_handshake_valid": 1, "probe_failed_due_to_regex": 0}},
+		{path: "/", password: "wrong", queryResponse: script, success: false,
+			results: map[string]float64{"probe_websocket_status_code": 401}},
+		{path: "/bad-accept", password: "secret", success: false,
+			results: map[string]float64{"probe_websocket_status_code": 101, "probe_websocket_handshake_valid": 0}},
+		{path: "/", password: "secret", success: false,
+			queryResponse: []config.WebSocketQueryResponse{{Expect: "^goodbye$", Timeout: 100 * time.Millisecond}},
+			results:       map[string]float64{"probe_failed_due_to_regex": 1}},
+	}
+	for i, test := range tests {
+		module := config.Module{
+			WebSocket: config.WebSocketProbe{
+				IPProtocol:         "ip4",
+				IPProtocolFallback: true,
+				HTTPClientConfig: pconfig.HTTPClientConfig{
+					BasicAuth: &pconfig.BasicAuth{Username: "probe", Password: pconfig.Secret(test.password)},
+				},
+				QueryResponse: test.queryResponse,
+			},
+		}
+		testCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		registry := prometheus.NewRegistry()
+		success := ProbeWebSocket(testCTX, "ws://"+ts.Listener.Addr().String()+test.path, module, registry, log.NewNopLogger())
+		cancel()
+		if success != test.success {
+			t.Fatalf("Test %d: expected success %v, got %v", i, test.success, success)
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRegistryResults(test.results, mfs, t)
+		if !test.success {
+			continue
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "probe_websocket_message_rtt_seconds" {
+				continue
+			}
+			if len(mf.GetMetric()) != 4 {
+				t.Errorf("Test %d: expected 4 message RTTs, got %d", i, len(mf.GetMetric()))
+			}
+		}
+	}
+}